@@ -6,9 +6,14 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/processcreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/ssocreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
@@ -20,7 +25,7 @@ func s3Get(s3url string) ([]byte, error) {
 	// With help from ChatGPT.
 
 	if s3svc == nil {
-		fmt.Println("*** AWS is not configured, S3 not available")
+		fmt.Println("*** AWS credentials not available, can't use S3")
 		fmt.Printf("*** cannot download %s\n", s3url)
 		return nil, errors.New("AWS not configured")
 	}
@@ -52,70 +57,100 @@ func s3Get(s3url string) ([]byte, error) {
 	return buffer.Bytes(), nil
 }
 
-// Simple wrapper around s3Get that saves to a file.
-func s3Download(s3url string, localFilePath string) error {
-	buffer, err := s3Get(s3url)
-	if err != nil {
-		return err
-	}
-
-	return os.WriteFile(localFilePath, buffer, 0600)
+// awsCredentialSources names the credential providers of the AWS SDK.
+var awsCredentialSources = map[string]string{
+	session.EnvProviderName:          "environment variables",
+	processcreds.ProviderName:        "credential_process",
+	ssocreds.ProviderName:            "SSO",
+	stscreds.ProviderName:            "assumed role",
+	stscreds.WebIdentityProviderName: "web identity",
+	ec2rolecreds.ProviderName:        "EC2 instance role",
 }
 
-// Return the value for a key under an S3 object's Metadata.
-func s3Metadata(s3url string, s3key string) (string, error) {
-	if s3svc == nil {
-		fmt.Println("*** AWS is not configured, S3 not available")
-		return "", errors.New("AWS not configured")
-	}
-
-	parts := strings.SplitN(s3url[5:], "/", 2)
-	if len(parts) != 2 {
-		return "", errors.New("invalid s3 URL")
+// awsCredentialSource describes the credential provider. Keys from the
+// shared config or credentials file are named with the file they're in.
+func awsCredentialSource(provider string) string {
+	if file, ok := strings.CutPrefix(provider, "SharedConfigCredentials"); ok {
+		return "shared credentials" + strings.Replace(file, ":", " in", 1)
+	} else if source, ok := awsCredentialSources[provider]; ok {
+		return source
 	}
+	return provider
+}
 
-	bucketName, objectKey := parts[0], parts[1]
-	// Create input parameters for the HeadObject operation
-	params := &s3.HeadObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(objectKey),
+// awsConfigured reports whether there is any AWS configuration to use,
+// so that workstations without it don't wait on the instance metadata
+// service.
+func awsConfigured() bool {
+	for _, k := range []string{"AWS_ACCESS_KEY_ID", "AWS_PROFILE", "AWS_CONFIG_FILE", "AWS_SHARED_CREDENTIALS_FILE"} {
+		if os.Getenv(k) != "" {
+			return true
+		}
 	}
-
-	// Call the HeadObject operation to retrieve metadata
-	resp, err := s3svc.HeadObject(params)
-	if err != nil {
-		fmt.Println("Error retrieving object metadata:", err)
-		return "", err
+	if config.AwsProfile != "" {
+		return true
 	}
-
-	// Search for the key in the Metadata
-	for key, value := range resp.Metadata {
-		if key == s3key {
-			return *value, nil
+	home, _ := os.UserHomeDir()
+	for _, f := range []string{"config", "credentials"} {
+		if _, err := os.Stat(filepath.Join(home, ".aws", f)); err == nil {
+			return true
 		}
 	}
-
-	return "", errors.New("Metadata key not found")
+	return false
 }
 
+// awsSetup creates the S3 client from the AWS SDK's usual configuration:
+// environment variables, then the profile from AwsProfile or AWS_PROFILE in
+// ~/.aws/config and ~/.aws/credentials, which may use SSO or
+// credential_process. It prints where the credentials came from.
 func awsSetup() {
 	defer fmt.Println("")
 
-	for _, k := range []string{"AWS_SECRET_ACCESS_KEY", "AWS_ACCESS_KEY_ID", "AWS_SESSION_TOKEN"} {
-		if os.Getenv(k) == "" {
-			fmt.Println("AWS: environment not set, using built-in and cached defaults")
-			return
-		}
+	if !awsConfigured() {
+		fmt.Println("AWS: not configured, using built-in and cached defaults")
+		return
 	}
 
-	sess, err := session.NewSession(
-		&aws.Config{
-			Region: aws.String("us-east-1"),
-		})
+	awsConfig := aws.Config{}
+	if config.AwsRegion != "" {
+		awsConfig.Region = aws.String(config.AwsRegion)
+	}
 
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            awsConfig,
+		Profile:           config.AwsProfile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
 	if err != nil {
-		fmt.Println("AWS: session failed, refresh your SSO session and environment vars")
-		os.Exit(1)
+		fmt.Println("*** AWS: session failed:", err)
+		return
+	}
+
+	// Neither the config nor the profile has a region.
+	if aws.StringValue(sess.Config.Region) == "" {
+		sess.Config.Region = aws.String("us-east-1")
+	}
+
+	profile := config.AwsProfile
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+	}
+
+	creds, err := sess.Config.Credentials.Get()
+	if err != nil {
+		fmt.Printf("*** AWS: no credentials for profile %s: %v\n", profile, err)
+		fmt.Printf("*** AWS: for SSO profiles, run: aws sso login --profile %s\n", profile)
+		return
+	}
+
+	source := awsCredentialSource(creds.ProviderName)
+	if creds.ProviderName == session.EnvProviderName {
+		fmt.Printf("AWS: using credentials from %s, region %s\n", source, *sess.Config.Region)
+	} else {
+		fmt.Printf("AWS: using credentials from %s, profile %s, region %s\n", source, profile, *sess.Config.Region)
 	}
 
 	s3svc = s3.New(sess)
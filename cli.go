@@ -0,0 +1,265 @@
+// Non-interactive subcommands, for scripts, CI jobs and Makefiles.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+)
+
+func cliUsage() {
+	fmt.Println("usage: rdevcon [-v] [-i keyfile] [-o option] [subcommand]")
+	fmt.Println("")
+	fmt.Println("Without a subcommand, rdevcon runs the interactive prompt.")
+	fmt.Println("")
+	fmt.Println("Subcommands:")
+	fmt.Println("  list [--json] [--all] [--probe] [online|offline]")
+	fmt.Println("                                     list devices, --all includes hidden devices,")
+	fmt.Println("                                     --probe checks which are connected to the hub")
+	fmt.Println("  connect <device or @group>         connect, and wait for the sessions to exit")
+	fmt.Println("  mount <device or @group>           sshfs mount, and wait for ctrl-c to unmount")
+	fmt.Println("  tunnel <device> [--foreground]     check the device is reachable, or with")
+	fmt.Println("                                     --foreground keep its tunnel open until ctrl-c")
+	fmt.Println("  ssh-config [--all] [--local-forward] [--output file]")
+	fmt.Println("                                     print an ssh config for the fleet")
+	fmt.Println("  run [options] <device or @group> [--] <command>")
+	fmt.Println("                                     run a command, see run -help")
+	fmt.Println("  version                            print the rdevcon version")
+	fmt.Println("  update [--channel name] [--allow-downgrade]")
+	fmt.Println("                                     install the latest release")
+	fmt.Println("  rollback                           go back to the version before the last update")
+	fmt.Println("  release keygen|sign ...            sign binaries for self-update, see release help")
+}
+
+// parseArgs parses flags appearing anywhere among args, and returns the
+// remaining positional arguments.
+func parseArgs(flags *flag.FlagSet, args []string) ([]string, error) {
+	flags.SetOutput(os.Stdout)
+	positional := []string{}
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// cliMain runs a subcommand, and returns the process exit code.
+func cliMain(dset *DeviceSet, args []string) int {
+	var err error
+
+	switch args[0] {
+	case "list":
+		err = cliList(dset, args[1:])
+	case "connect":
+		err = cliConnect(dset, args[1:], (*Device).connect)
+	case "mount":
+		err = cliConnect(dset, args[1:], (*Device).mount)
+	case "tunnel":
+		err = cliTunnel(dset, args[1:])
+	case "ssh-config":
+		err = cliSshConfig(dset, args[1:])
+	case "run":
+		return runMain(dset, args[1:])
+	case "update":
+		err = cliUpdate(args[1:])
+	case "rollback":
+		err = rollback()
+	case "version":
+		fmt.Println(version)
+	case "release":
+		err = cliRelease(args[1:])
+	case "help", "-h", "-help", "--help":
+		cliUsage()
+	default:
+		cliUsage()
+		return 2
+	}
+
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func cliList(dset *DeviceSet, args []string) error {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print devices as JSON")
+	all := flags.Bool("all", false, "include hidden devices")
+	probe := flags.Bool("probe", false, "check which devices are connected to the hub")
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+
+	filter := ""
+	if len(positional) > 0 {
+		filter = positional[0]
+	}
+
+	dset.unlockHidden = *all
+
+	// Probe first, with any messages going to stderr.
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	if *probe {
+		err = dset.probe(dset.visible())
+	} else if filter != "" {
+		err = dset.probeStale()
+	}
+	os.Stdout = stdout
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		devices := []deviceStatus{}
+		for _, status := range dset.statusList() {
+			if filter == "" || status.Online == filter {
+				devices = append(devices, status)
+			}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(devices)
+	}
+
+	return dset.list(filter)
+}
+
+func cliSshConfig(dset *DeviceSet, args []string) error {
+	flags := flag.NewFlagSet("ssh-config", flag.ContinueOnError)
+	all := flags.Bool("all", false, "include hidden devices")
+	localForward := flags.Bool("local-forward", false, "forward device ports from the hub entry instead of using ProxyJump")
+	output := flags.String("output", "", "write to a file instead of stdout, like ~/.ssh/rdevcon_config")
+	if _, err := parseArgs(flags, args); err != nil {
+		return err
+	}
+
+	dset.unlockHidden = *all
+	if *output != "" {
+		return dset.writeSshConfig(*output, *localForward)
+	}
+	return dset.sshConfig(os.Stdout, *localForward)
+}
+
+// cliConnect starts connections with action, then waits for them all to
+// finish. Ctrl-c closes them.
+func cliConnect(dset *DeviceSet, args []string, action func(dev *Device) error) error {
+	flags := flag.NewFlagSet("connect", flag.ContinueOnError)
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errors.New("expected one device or @group")
+	}
+
+	defer tunnels.closeAll()
+
+	err = dset.forEach(positional[0], action)
+	if len(dset.connections) > 0 {
+		cliWait(dset)
+	}
+	return err
+}
+
+// cliWait services connection and tunnel events until every connection
+// has finished. The first ctrl-c closes all connections, a second exits
+// immediately.
+func cliWait(dset *DeviceSet) {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	interrupted := false
+	for len(dset.connections) > 0 {
+		select {
+		case con := <-dset.connectionFinish:
+			delete(dset.connections, con)
+		case dev := <-dset.tunnelFinish:
+			fmt.Printf("tunnel for %s closed: %s\n", dev.Serial, tunnels.state(dev))
+			dset.teardown(dev)
+		case <-interrupt:
+			if interrupted {
+				return
+			}
+			interrupted = true
+			fmt.Println("closing connections, ctrl-c again to exit now")
+			for con := range dset.connections {
+				con.close()
+			}
+		}
+	}
+}
+
+// cliTunnel opens a device's tunnel, which shows that the device is
+// reachable through the hub. Tunnels only last as long as rdevcon runs,
+// so --foreground is needed to keep it open for other programs.
+func cliTunnel(dset *DeviceSet, args []string) error {
+	flags := flag.NewFlagSet("tunnel", flag.ContinueOnError)
+	foreground := flags.Bool("foreground", false, "keep the tunnel open until ctrl-c")
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errors.New("expected one device")
+	}
+
+	dev := dset.find(positional[0])
+	if dev == nil {
+		return fmt.Errorf("%w: %s", errUnknownDevice, positional[0])
+	}
+
+	defer tunnels.closeAll()
+
+	if err := dev.tunnelSetup(); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s reachable at localhost:%d\n", dev.Serial, dev.port)
+	if !*foreground {
+		return nil
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	fmt.Println("ctrl-c to close the tunnel")
+	for {
+		select {
+		case <-interrupt:
+			return nil
+		case closed := <-dset.tunnelFinish:
+			if closed == dev {
+				return fmt.Errorf("tunnel for %s closed: %s", dev.Serial, tunnels.state(dev))
+			}
+		}
+	}
+}
+
+func cliUpdate(args []string) error {
+	opts, err := parseUpdateArgs(args)
+	if err != nil {
+		return err
+	}
+	installed, err := selfUpdate(opts)
+	if installed {
+		fmt.Println("Update installed.")
+	}
+	return err
+}
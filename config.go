@@ -16,16 +16,34 @@ import (
 var config_json string
 
 type Config struct {
-	DevicesPath      string
-	TunnelKeyPath    string
-	TunnelNameAddr   string
-	SelfUpdatePath   string
-	PortOffset       int
-	Forwards         string
-	AnonUser         string
-	Verbose          bool
-	SshOptionList    []string
-	UseLoopbackAddrs bool
+	DevicesPath         string
+	TunnelKeyPath       string
+	TunnelNameAddr      string
+	HubFingerprints     []string
+	HubFingerprintsPath string
+	AwsProfile          string
+	AwsRegion           string
+	SelfUpdatePath      string
+	UpdatePublicKey     string
+	UpdateChannel       string
+	PortOffset          int
+	Forwards            forwardSpecs
+	AnonUser            string
+	Verbose             bool
+	SshOptionList       []string
+	UseLoopbackAddrs    bool
+	WebPort             int
+	Shell               string
+	Env                 map[string]string
+	SshfsRoot           string
+	VncPort             int
+	Vnc                 *bool
+	VncViewer           string
+	RunParallel         int
+	RunTimeout          int
+	ProbeOnList         bool
+	AutoShiftPorts      bool
+	ReloadInterval      int
 }
 
 var config *Config
@@ -39,6 +57,10 @@ func ConfigLoad() *Config {
 		fmt.Println("embedded config error:", err)
 	}
 
+	// The update signing key can only be compiled in, so that a local
+	// config.json can't authorize other binaries.
+	updatePublicKey := config.UpdatePublicKey
+
 	// If a local config.json is found, it can override
 	// any or all values
 	if _, err := os.Stat("config.json"); err == nil {
@@ -51,6 +73,13 @@ func ConfigLoad() *Config {
 		}
 	}
 
+	config.UpdatePublicKey = updatePublicKey
+
+	if err := config.Forwards.validate(); err != nil {
+		fmt.Printf("*** Forwards: %v, ignoring them\n", err)
+		config.Forwards = nil
+	}
+
 	// Replace placeholders in SelfUpdatePath
 	config.SelfUpdatePath = strings.Replace(config.SelfUpdatePath,
 		"$platform",
@@ -63,6 +92,16 @@ func ConfigLoad() *Config {
 		filepath.Base(executable),
 		1)
 
+	if config.UpdateChannel == "" {
+		config.UpdateChannel = "stable"
+	}
+	if config.RunParallel == 0 {
+		config.RunParallel = 8
+	}
+	if config.RunTimeout == 0 {
+		config.RunTimeout = 60
+	}
+
 	setLoopback(config.UseLoopbackAddrs)
 
 	return config
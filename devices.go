@@ -5,45 +5,72 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"net"
 	"os"
 	"os/exec"
-	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
 type Connection struct {
-	dev       *Device
-	cmd       *exec.Cmd
-	forwarded bool
+	id         int
+	dev        *Device
+	cmd        *exec.Cmd
+	forwarded  bool
+	forwards   []forward
+	mountPoint string
+
+	// ssh control socket of the session, see controlPath.
+	controlPath string
+
+	// Background ssh -N holding only a VNC forward, see vnc.go.
+	forwardOnly bool
 }
 
 type Device struct {
 	// Note that some fields in the JSON device database are ignored.
-	Serial       string `json:"serial"`
-	ID           string `json:"id"`
-	User         string `json:"user"`
-	offset       int
-	port         int
-	Location     string `json:"allocation"`
-	Comment      string `json:"notes"`
-	parent       *DeviceSet
-	tunnelCmd    *exec.Cmd
-	Hidden       bool `json:"hidden"`
-	mounted      bool
+	Serial   string `json:"serial"`
+	ID       string `json:"id"`
+	User     string `json:"user"`
+	offset   int
+	port     int
+	Location string `json:"allocation"`
+	Comment  string `json:"notes"`
+	parent   *DeviceSet
+	Hidden   bool     `json:"hidden"`
+	Tags     []string `json:"tags"`
+	mounted  bool
+	probe    probeResult
+
+	// Set once the host key has been checked this session, see hostkeys.go.
+	hostKeyChecked bool
+
+	// Optional connection profile, see profile.go.
+	Forwards   forwardSpecs      `json:"forwards"`
+	SshOptions []string          `json:"ssh_options"`
+	Shell      string            `json:"shell"`
+	Env        map[string]string `json:"env"`
+	SshfsRoot  string            `json:"sshfs_root"`
+	VncPort    int               `json:"vnc_port"`
+	Vnc        *bool             `json:"vnc"`
 }
 
 type DeviceSet struct {
-	deviceList          []*Device
-	devicesBySerial     map[string]*Device
-	tunnelFinish        chan *Device
-	connectionFinish    chan *Connection
-	connections         map[*Connection]bool
-	unlockHidden        bool
+	deviceList       []*Device
+	devicesBySerial  map[string]*Device
+	tunnelFinish     chan *Device
+	connectionFinish chan *Connection
+	connections      map[*Connection]bool
+	lastConnectionID int
+	unlockHidden     bool
+
+	// When the device database was last fetched, if it came from the cache
+	// because DevicesPath couldn't be reached.
+	staleSince time.Time
 }
 
 func sshVerbose() string {
@@ -66,19 +93,13 @@ func (dev *Device) getLoopbackAddr() string {
 	}
 }
 
-func (dev *Device) ConnectCommand(addForwards bool) []string {
+func (dev *Device) ConnectCommand(forwardList []forward, controlPath string) []string {
 	forwards := ""
-	if addForwards {
-		if config.UseLoopbackAddrs {
-			forwards += strings.ReplaceAll(config.Forwards, "-L", fmt.Sprintf("-L%s:", dev.getLoopbackAddr()))
-		} else {
-			forwards = config.Forwards
-		}
-
-		vncPort := dev.port - config.PortOffset + 5900
-		vncForward := fmt.Sprintf("%s:%d", dev.getLoopbackAddr(), vncPort)
-		forwards += fmt.Sprintf(" -L%s:localhost:%d", vncForward, vncPort)
-		fmt.Printf("VNC server at %s\n", vncForward)
+	for _, fwd := range forwardList {
+		forwards += " " + fwd.arg()
+	}
+	if controlPath != "" {
+		forwards += fmt.Sprintf(" -o ControlMaster=yes -o ControlPath=%s", controlPath)
 	}
 
 	// Pass along AWS env vars, if set. Only implemented in Linux and macOS for now.
@@ -91,6 +112,9 @@ func (dev *Device) ConnectCommand(addForwards bool) []string {
 		}
 	}
 
+	// Configured environment for the device.
+	env_vars += dev.envVars()
+
 	// Pass along git user and email, if they can be ascertained.
 	gitArgs := strings.Fields("git config --global -l")
 	cmd := exec.Command(gitArgs[0], gitArgs[1:]...)
@@ -116,19 +140,19 @@ func (dev *Device) ConnectCommand(addForwards bool) []string {
 	}
 
 	// The ssh command should be the same across all platforms.
-	ssh_command := fmt.Sprintf("ssh -A %s -o StrictHostKeychecking=no -o UserKnownHostsFile=/dev/null -t -p %d %s %s@localhost %s bash -l",
-		config.sshOptions(), dev.port, forwards, dev.User, env_vars)
+	ssh_command := fmt.Sprintf("ssh -A %s %s -t -p %d %s %s@localhost %s %s",
+		dev.sshOptions(), dev.hostKeyOptions(), dev.port, forwards, dev.User, env_vars, dev.shell())
 
 	if config.Verbose {
 		fmt.Println(ssh_command)
 	}
 
 	// Always show sftp access method.
-	fmt.Printf("\nFor file transfers to device %s:\nsftp -o StrictHostKeychecking=no -o UserKnownHostsFile=/dev/null -P %d %s@localhost\n",
-		dev.Serial, dev.port, dev.User)
+	fmt.Printf("\nFor file transfers to device %s:\nsftp %s -P %d %s@localhost\n",
+		dev.Serial, dev.hostKeyOptions(), dev.port, dev.User)
 
 	// And the ssh-copy-id command.
-	fmt.Printf("\nTo install your default pubkey on device %s:\nssh-copy-id -o StrictHostKeychecking=no -o UserKnownHostsFile=/dev/null -p %d %s@localhost\n\n", dev.Serial, dev.port, dev.User)
+	fmt.Printf("\nTo install your default pubkey on device %s:\nssh-copy-id %s -p %d %s@localhost\n\n", dev.Serial, dev.hostKeyOptions(), dev.port, dev.User)
 
 	// Return os-specific command to connect to device.
 	if runtime.GOOS == "windows" {
@@ -147,102 +171,49 @@ func (dev *Device) ConnectCommand(addForwards bool) []string {
 	}
 }
 
-func (dev *Device) tunnelSetup() {
-	var err error
-	var sshTunnelKeyFile string
-
-	if dev.tunnelCmd != nil {
-		return
-	}
-
-	// If the key is on S3, make a temporary local copy, with deferred removal.
-	if strings.HasPrefix(config.TunnelKeyPath, "s3://") {
-		sshTunnelKeyFile = ".tunnel_key"
-		if err = s3Download(config.TunnelKeyPath, sshTunnelKeyFile); err != nil {
-			return
-		}
-		os.Chmod(sshTunnelKeyFile, 0600)
-		defer os.Remove(sshTunnelKeyFile)
-	} else {
-		sshTunnelKeyFile = config.TunnelKeyPath
-	}
-
-	tunnelArgs := strings.Fields(fmt.Sprintf("ssh -i %s %s -o StrictHostKeyChecking=accept-new -L%d:localhost:%d -N %s",
-		sshTunnelKeyFile, config.sshOptions(), dev.port, dev.port, config.TunnelNameAddr))
-	fmt.Println(tunnelArgs)
-
-	// Start the tunnel command.
-	dev.tunnelCmd = exec.Command(tunnelArgs[0], tunnelArgs[1:]...)
-	dev.tunnelCmd.Stderr = os.Stderr
-
-	if err = dev.tunnelCmd.Start(); err != nil {
-		fmt.Println(err)
-		dev.tunnelCmd = nil
-		return
-	}
-
-	go func() {
-		dev.tunnelCmd.Wait()
-		fmt.Println("tunnel exited")
-		dev.tunnelCmd = nil
-	}()
-
-	// Wait for tunnel port to be available.
-	for {
-		if conn, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%d", dev.port), 1*time.Second); err == nil {
-			// Tunnel ready and forwarding.
-			conn.Close()
-			break
-		}
-		if dev.tunnelCmd == nil {
-			// Tunnel exited for some reason.
-			break
-		}
-		time.Sleep(250 * time.Millisecond)
+// tunnelSetup makes the device's ssh port available on localhost via the
+// hub, and checks that the device is the one whose host key is pinned.
+func (dev *Device) tunnelSetup() error {
+	if err := tunnels.open(dev); err != nil {
+		return err
 	}
+	return dev.verifyHostKey()
 }
 
-func (dev *Device) connect() {
+func (dev *Device) connect() error {
 	var err error
 
-	dev.tunnelSetup()
-	if dev.tunnelCmd == nil {
-		return
+	if err = dev.tunnelSetup(); err != nil {
+		return err
 	}
 
-	// Test if the first forwarded port is already being listened on.
-	// If not, enable all the forwards.
-	firstForwardedPort := -1
-
-	re := regexp.MustCompile(`-L(\d+):`)
-	match := re.FindStringSubmatch(config.Forwards)
-	if len(match) >= 2 {
-		firstForwardedPort = atoi(match[1])
-	}
-
-	if firstForwardedPort != -1 {
-		testAddr := fmt.Sprintf("%s:%d", dev.getLoopbackAddr(), firstForwardedPort)
-
-		if conn, err := net.DialTimeout("tcp", testAddr, 1*time.Second); err == nil {
-			conn.Close()
-			firstForwardedPort = -1
-			fmt.Printf("*** %s already in use, not forwarding\n", testAddr)
-		} else {
-			fmt.Printf("+++ using %s forwards\n", dev.getLoopbackAddr())
-		}
-	}
+	forwards := dev.forwardList()
 
 	if config.UseLoopbackAddrs {
 		if err = enableLoopbackAddr(dev.getLoopbackAddr()); err != nil {
-			fmt.Println(err)
-			return
-
+			return err
 		}
 	}
 
-	addForwards := (firstForwardedPort != -1)
+	// Only one session can hold the forwards, per device in loopback mode
+	// or overall otherwise. Otherwise each forward's port is checked, in
+	// case something else is listening on it.
+	if holder := dev.parent.forwardHolder(dev); holder != nil {
+		fmt.Printf("*** forwards are held by connection %d to %s, not forwarding\n", holder.id, holder.dev.Serial)
+		if !config.UseLoopbackAddrs {
+			fmt.Println("*** use loopback to forward for several devices at once")
+		}
+		forwards = nil
+	} else {
+		fmt.Printf("+++ using %s forwards\n", dev.getLoopbackAddr())
+		if forwards = checkPorts(forwards); len(forwards) == 0 {
+			forwards = nil
+		}
+	}
 
-	connectArgs := dev.ConnectCommand(addForwards)
+	// The id that addConnection will assign.
+	control := controlPath(dev.parent.lastConnectionID + 1)
+	connectArgs := dev.ConnectCommand(forwards, control)
 
 	if _, exists := os.LookupEnv("RDEVCON_DEBUG"); exists {
 		fmt.Println(connectArgs)
@@ -250,45 +221,45 @@ func (dev *Device) connect() {
 
 	cmd := exec.Command(connectArgs[0], connectArgs[1:]...)
 	if err = cmd.Start(); err != nil {
-		fmt.Println(err)
-		return
+		return err
 	}
 
-	con := &Connection{dev, cmd, addForwards}
-
-	dev.parent.connections[con] = true
+	con := dev.parent.addConnection(&Connection{dev: dev, cmd: cmd, forwarded: forwards != nil, forwards: forwards,
+		controlPath: control})
+	for _, fwd := range forwards {
+		fmt.Printf("forward: %s\n", fwd)
+	}
 
 	go func() {
 		cmd.Wait()
 		dev.parent.connectionFinish <- con
 	}()
+
+	return nil
 }
 
 // mount sets up an sshfs mount of the remote device filesystem to the local
 // system.
-func (dev *Device) mount() {
+func (dev *Device) mount() error {
 	var err error
 	if runtime.GOOS == "windows" {
-		return
+		return errors.New("sshfs not supported on Windows")
 	}
 
 	if dev.Hidden {
-		fmt.Println("sshfs not allowed on hidden devices")
-		return
+		return errors.New("sshfs not allowed on hidden devices")
 	}
 
 	if dev.mounted {
-		fmt.Println("already mounted")
-		return
+		return fmt.Errorf("%s already mounted", dev.Serial)
 	}
 
-	dev.tunnelSetup()
-	if dev.tunnelCmd == nil {
-		return
+	if err = dev.tunnelSetup(); err != nil {
+		return err
 	}
 
-	mountArgs := strings.Fields(fmt.Sprintf("sshfs -f %s -o BatchMode=yes -o StrictHostKeychecking=no -o UserKnownHostsFile=/dev/null -o port=%d %s@%s:/",
-		config.sshOptions(), dev.port, dev.User, dev.getLoopbackAddr()))
+	mountArgs := strings.Fields(fmt.Sprintf("sshfs -f %s -o BatchMode=yes %s -o port=%d %s@%s:%s",
+		dev.sshOptions(), dev.hostKeyOptions(), dev.port, dev.User, dev.getLoopbackAddr(), dev.sshfsRoot()))
 
 	mountPoint := fmt.Sprintf("%s/sshfs/%s", os.Getenv("HOME"), dev.Serial)
 	os.MkdirAll(mountPoint, 0700)
@@ -302,13 +273,10 @@ func (dev *Device) mount() {
 	cmd.Stderr = &errBuffer
 
 	if err = cmd.Start(); err != nil {
-		fmt.Println(err)
-		return
+		return err
 	}
 
-	con := &Connection{dev, cmd, false}
-
-	dev.parent.connections[con] = true
+	con := dev.parent.addConnection(&Connection{dev: dev, cmd: cmd, mountPoint: mountPoint})
 
 	dev.mounted = true
 
@@ -326,6 +294,108 @@ func (dev *Device) mount() {
 		}
 	}()
 
+	return nil
+}
+
+// close ends a connection. Sshfs mounts are unmounted so that sshfs can
+// exit cleanly, anything else is killed. Either way the connection is
+// removed from the set when its process exits.
+func (con *Connection) close() error {
+	if con.mountPoint != "" {
+		var unmountArgs []string
+		if runtime.GOOS == "darwin" {
+			unmountArgs = []string{"umount", con.mountPoint}
+		} else {
+			unmountArgs = []string{"fusermount", "-u", con.mountPoint}
+		}
+		if err := exec.Command(unmountArgs[0], unmountArgs[1:]...).Run(); err == nil {
+			return nil
+		}
+	}
+
+	err := con.cmd.Process.Kill()
+
+	if con.mountPoint != "" && runtime.GOOS == "linux" {
+		// The mount may be busy, detach it lazily rather than leaving a
+		// stale mount point behind.
+		exec.Command("fusermount", "-u", "-z", con.mountPoint).Run()
+	}
+
+	return err
+}
+
+// teardown closes every connection that depends on the device's tunnel,
+// which releases the common forwards if one of them held them, and
+// prints a summary. The connections are removed from the set as their
+// processes exit.
+func (dset *DeviceSet) teardown(dev *Device) {
+	sessions, mounts := 0, 0
+	for _, con := range dset.sortedConnections() {
+		if con.dev != dev {
+			continue
+		}
+		if err := con.close(); err != nil {
+			fmt.Printf("error closing connection %d: %v\n", con.id, err)
+			continue
+		}
+		con.forwarded, con.forwards = false, nil
+		if con.mountPoint != "" {
+			mounts++
+		} else {
+			sessions++
+		}
+	}
+	fmt.Printf("%s: closed %d ssh session(s), unmounted %d sshfs mount(s)\n", dev.Serial, sessions, mounts)
+}
+
+// disconnect closes the device's tunnel and everything using it.
+func (dev *Device) disconnect() {
+	tunnels.close(dev)
+	dev.parent.teardown(dev)
+}
+
+func (con *Connection) kind() string {
+	if con.mountPoint != "" {
+		return "sshfs"
+	} else if con.forwardOnly {
+		return "vnc"
+	}
+	return "ssh"
+}
+
+// addConnection assigns the next connection id and adds con to the set.
+func (dset *DeviceSet) addConnection(con *Connection) *Connection {
+	dset.lastConnectionID++
+	con.id = dset.lastConnectionID
+	dset.connections[con] = true
+	return con
+}
+
+func (dset *DeviceSet) findConnection(id int) *Connection {
+	for con := range dset.connections {
+		if con.id == id {
+			return con
+		}
+	}
+	return nil
+}
+
+func (dset *DeviceSet) listConnections() {
+	fmt.Print("\nActive connections:\n")
+	fmt.Printf("id, kind, serial\n")
+	for _, con := range dset.sortedConnections() {
+		fmt.Printf("%d, %s, %s\n", con.id, con.kind(), con.dev.Serial)
+	}
+}
+
+// sortedConnections returns the connections ordered by id.
+func (dset *DeviceSet) sortedConnections() []*Connection {
+	cons := make([]*Connection, 0, len(dset.connections))
+	for con := range dset.connections {
+		cons = append(cons, con)
+	}
+	sort.Slice(cons, func(i, j int) bool { return cons[i].id < cons[j].id })
+	return cons
 }
 
 func (dset *DeviceSet) add(d *Device) {
@@ -333,15 +403,52 @@ func (dset *DeviceSet) add(d *Device) {
 	dset.devicesBySerial[d.Serial] = d
 }
 
-func (dset *DeviceSet) list() {
+// visible returns the devices that aren't hidden, or all of them if hidden
+// devices are unlocked.
+func (dset *DeviceSet) visible() []*Device {
+	var devices []*Device
+	for _, dev := range dset.deviceList {
+		if !dev.Hidden || dset.unlockHidden {
+			devices = append(devices, dev)
+		}
+	}
+	return devices
+}
+
+// list prints the visible devices. With filter "online" or "offline",
+// the devices are probed first if needed, and only matching devices are
+// listed.
+func (dset *DeviceSet) list(filter string) error {
+	if filter != "" && filter != "online" && filter != "offline" {
+		return fmt.Errorf("unknown list filter %q, expected online or offline", filter)
+	}
+
+	if filter != "" || config.ProbeOnList {
+		if err := dset.probeStale(); err != nil {
+			fmt.Println("probe:", err)
+		}
+	}
+
 	fmt.Print("\nAvailable devices:\n")
-	fmt.Printf("serial, id, location, (comment)\n")
+	if notice := dset.staleNotice(); notice != "" {
+		fmt.Println(notice)
+	}
+	fmt.Printf("serial, id, location, (comment), tunnel, status\n")
 	for _, device := range dset.deviceList {
 		if device.Hidden && !dset.unlockHidden {
 			continue
 		}
-		fmt.Printf("%s, %4d, %s, (%s)\n", device.Serial, device.offset, device.Location, device.Comment)
+		if (filter == "online" && !device.probe.online) || (filter == "offline" && device.probe.online) {
+			continue
+		}
+		tunnel := tunnels.state(device)
+		if tunnel == "" {
+			tunnel = "-"
+		}
+		fmt.Printf("%s, %4d, %s, (%s), %s, %s\n", device.Serial, device.offset, device.Location, device.Comment, tunnel, device.onlineStatus())
 	}
+
+	return nil
 }
 
 func (dset *DeviceSet) find(s string) *Device {
@@ -382,34 +489,109 @@ func (dset *DeviceSet) find(s string) *Device {
 func loadDevices() *DeviceSet {
 	fmt.Printf("Device database: %s\n", config.DevicesPath)
 
-	if strings.HasPrefix(config.DevicesPath, "s3://") {
-		if result, err := s3Get(config.DevicesPath); err == nil {
-			device_database = string(result)
-		} else {
-			fmt.Printf("*** AWS: failed to get %s from S3\n", config.DevicesPath)
-			fmt.Println("*** AWS: Try refreshing your credentials and environment variables")
-			os.Exit(1)
-		}
-	}
-
 	dset := &DeviceSet{tunnelFinish: make(chan *Device), connectionFinish: make(chan *Connection),
 		devicesBySerial: make(map[string]*Device),
 		connections:     make(map[*Connection]bool)}
 
-	var devices []*Device
-	err := json.Unmarshal([]byte(device_database), &devices)
+	database := device_database
+	if config.DevicesPath != "" {
+		if result, staleSince, err := fetchDeviceDatabase(); err == nil {
+			database = result
+			dset.staleSince = staleSince
+		} else {
+			fmt.Println(err)
+			fmt.Println("*** using the built-in device database")
+		}
+	}
+
+	devices, err := parseDevices(database)
 	if err != nil {
 		fmt.Println("Error parsing JSON:", err)
-	} else {
-		for _, d := range devices {
-			if d.ID != "" {
-				d.offset = atoi(d.ID)
-				d.port = d.offset + config.PortOffset
-				d.parent = dset
-				dset.add(d)
-			}
-		}
+	}
+	for _, d := range devices {
+		d.parent = dset
+		dset.add(d)
+	}
+
+	if notice := dset.staleNotice(); notice != "" {
+		fmt.Println(notice)
 	}
 
 	return dset
 }
+
+// fetchDeviceDatabase gets the device database from DevicesPath, or its
+// cached copy, see fetchCached.
+func fetchDeviceDatabase() (string, time.Time, error) {
+	result, staleSince, err := fetchCached(config.DevicesPath)
+	if err != nil {
+		err = fmt.Errorf("*** failed to get %s: %w", config.DevicesPath, err)
+		if strings.HasPrefix(config.DevicesPath, "s3://") {
+			err = fmt.Errorf("%w\n*** AWS: Try refreshing your credentials, or aws sso login for SSO profiles", err)
+		}
+		return "", time.Time{}, err
+	}
+	return string(result), staleSince, nil
+}
+
+// parseDevices parses a device database. Entries without an id are skipped.
+// A device with invalid forwards is kept, without them.
+func parseDevices(database string) ([]*Device, error) {
+	var entries []json.RawMessage
+	if err := json.Unmarshal([]byte(database), &entries); err != nil {
+		return nil, err
+	}
+
+	var devices []*Device
+	for _, raw := range entries {
+		d, err := parseDevice(raw)
+		if err != nil {
+			return nil, err
+		}
+		if d.ID != "" {
+			d.offset = atoi(d.ID)
+			d.port = d.offset + config.PortOffset
+			devices = append(devices, d)
+		}
+	}
+	return devices, nil
+}
+
+// deviceAlias is a Device without its methods, so that parseDevice can
+// decode an entry's forwards separately.
+type deviceAlias Device
+
+// parseDevice decodes one device database entry. Bad forwards are
+// reported with the device's serial, and the device falls back to the
+// common forwards, rather than failing the whole database.
+func parseDevice(raw json.RawMessage) (*Device, error) {
+	d := &Device{}
+	entry := struct {
+		*deviceAlias
+		Forwards json.RawMessage `json:"forwards"`
+	}{deviceAlias: (*deviceAlias)(d)}
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		return nil, err
+	}
+
+	if entry.Forwards != nil {
+		err := json.Unmarshal(entry.Forwards, &d.Forwards)
+		if err == nil {
+			err = d.Forwards.validate()
+		}
+		if err != nil {
+			fmt.Printf("*** %s forwards: %v, using the common forwards\n", d.Serial, err)
+			d.Forwards = nil
+		}
+	}
+	return d, nil
+}
+
+// staleNotice returns a warning if the device database came from the cache.
+func (dset *DeviceSet) staleNotice() string {
+	if dset.staleSince.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf("*** stale inventory from %s, %s is unreachable",
+		dset.staleSince.Format(time.DateTime), config.DevicesPath)
+}
@@ -0,0 +1,179 @@
+// Fetching distributed resources, like the device database, tunnel key and
+// updates, from S3, a web server or local files.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const fetchTimeout = 2 * time.Minute
+
+var fetchClient = &http.Client{Timeout: fetchTimeout}
+
+var errNotModified = errors.New("not modified")
+
+// Resources like the device database end up in local ssh command lines,
+// so they're never fetched over plain http.
+var errPlainHTTP = errors.New("plain http isn't supported, use https://")
+
+// A cached copy of a fetched resource, see fetchCached.
+type fetchCacheEntry struct {
+	Location string    `json:"location"`
+	ETag     string    `json:"etag,omitempty"`
+	Fetched  time.Time `json:"fetched"`
+}
+
+// localPath returns the file path for file:// URLs and plain paths.
+func localPath(location string) (string, bool) {
+	if path, ok := strings.CutPrefix(location, "file://"); ok {
+		return path, true
+	}
+	if strings.Contains(location, "://") {
+		return "", false
+	}
+	return location, true
+}
+
+func isHTTP(location string) bool {
+	return strings.HasPrefix(location, "https://")
+}
+
+// fetch returns the contents of location, which can be an s3://bucket/key
+// URL, an https:// URL, a file:// URL or a local path.
+func fetch(location string) ([]byte, error) {
+	if strings.HasPrefix(location, "http://") {
+		return nil, fmt.Errorf("%s: %w", location, errPlainHTTP)
+	} else if strings.HasPrefix(location, "s3://") {
+		return s3Get(location)
+	} else if isHTTP(location) {
+		data, _, err := httpGet(location, "")
+		return data, err
+	} else if path, ok := localPath(location); ok {
+		return os.ReadFile(path)
+	}
+	return nil, fmt.Errorf("unsupported location %s", location)
+}
+
+// httpGet fetches an http(s) URL, and returns its ETag. If etag is given
+// and the resource still has it, errNotModified is returned.
+func httpGet(url string, etag string) ([]byte, string, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && etag != "" {
+		return nil, etag, errNotModified
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, resp.Header.Get("ETag"), nil
+}
+
+func fetchCachePath(location string) string {
+	sum := sha256.Sum256([]byte(location))
+	return filepath.Join(cacheDir(), "fetch", hex.EncodeToString(sum[:8]))
+}
+
+// readFetchCache returns the cached copy of location, if there is one.
+func readFetchCache(location string) ([]byte, *fetchCacheEntry) {
+	path := fetchCachePath(location)
+	meta, err := os.ReadFile(path + ".json")
+	if err != nil {
+		return nil, nil
+	}
+	entry := &fetchCacheEntry{}
+	if json.Unmarshal(meta, entry) != nil || entry.Location != location {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path + ".data")
+	if err != nil {
+		return nil, nil
+	}
+	return data, entry
+}
+
+func writeFetchCache(entry *fetchCacheEntry, data []byte) {
+	path := fetchCachePath(entry.Location)
+	os.MkdirAll(filepath.Dir(path), 0700)
+	meta, _ := json.Marshal(entry)
+	if data != nil {
+		if os.WriteFile(path+".data", data, 0600) != nil {
+			return
+		}
+	}
+	os.WriteFile(path+".json", meta, 0600)
+}
+
+// fetchCached is like fetch, but keeps a copy of remote resources in the
+// cache directory. For http(s) URLs with an ETag, the copy is reused if
+// the server says it hasn't changed. If the resource can't be fetched, the
+// cached copy is returned along with when it was fetched, otherwise the
+// returned time is zero. Not for secrets, like the tunnel key.
+func fetchCached(location string) ([]byte, time.Time, error) {
+	if strings.HasPrefix(location, "http://") {
+		// Not even a copy cached by an earlier version is used.
+		return nil, time.Time{}, fmt.Errorf("%s: %w", location, errPlainHTTP)
+	} else if _, ok := localPath(location); ok {
+		data, err := fetch(location)
+		return data, time.Time{}, err
+	}
+
+	cached, entry := readFetchCache(location)
+	if entry == nil {
+		entry = &fetchCacheEntry{Location: location}
+	}
+
+	var data []byte
+	var err error
+	if isHTTP(location) {
+		var etag string
+		data, etag, err = httpGet(location, entry.ETag)
+		if errors.Is(err, errNotModified) {
+			entry.Fetched = time.Now()
+			writeFetchCache(entry, nil)
+			return cached, time.Time{}, nil
+		}
+		entry.ETag = etag
+	} else {
+		data, err = fetch(location)
+		entry.ETag = ""
+	}
+
+	if err != nil {
+		if cached == nil {
+			return nil, time.Time{}, err
+		}
+		fmt.Printf("*** %s: %v, using cached copy from %s\n", location, err, entry.Fetched.Format(time.DateTime))
+		return cached, entry.Fetched, nil
+	}
+
+	entry.Fetched = time.Now()
+	writeFetchCache(entry, data)
+	return data, time.Time{}, nil
+}
@@ -0,0 +1,397 @@
+// Port forwards held by device sessions.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// A port forward. Local forwards ("L") listen on the workstation at
+// Bind:Port and connect to Host:HostPort from the device, remote forwards
+// ("R") the other way around. Name and Protocol, like http, vnc or
+// postgres, label the forward for display.
+type forward struct {
+	Name      string `json:"name,omitempty"`
+	Direction string `json:"direction"`
+	Bind      string `json:"bind,omitempty"`
+	Port      int    `json:"port"`
+	Host      string `json:"host,omitempty"`
+	HostPort  int    `json:"host_port"`
+	Protocol  string `json:"protocol,omitempty"`
+}
+
+// Forwards in the config file or device database, either a list of forward
+// objects or, as before, a string of ssh -L and -R options.
+type forwardSpecs []forward
+
+type forwardStatus struct {
+	Serial     string `json:"serial"`
+	Connection int    `json:"connection"`
+	forward
+}
+
+var errInvalidForward = errors.New("invalid forward")
+
+func (specs *forwardSpecs) UnmarshalJSON(data []byte) error {
+	var options string
+	if err := json.Unmarshal(data, &options); err == nil {
+		forwards, err := parseForwards(options)
+		*specs = forwards
+		return err
+	}
+	var forwards []forward
+	if err := json.Unmarshal(data, &forwards); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidForward, err)
+	}
+	*specs = forwards
+	return nil
+}
+
+// parseForwards parses ssh -L and -R options, like "-L8080:localhost:80
+// -R 9000:localhost:9000".
+func parseForwards(options string) (forwardSpecs, error) {
+	var forwards forwardSpecs
+	fields := strings.Fields(options)
+	for i := 0; i < len(fields); i++ {
+		option := fields[i]
+		if !strings.HasPrefix(option, "-L") && !strings.HasPrefix(option, "-R") {
+			return nil, fmt.Errorf("%w %q, expected -L or -R", errInvalidForward, option)
+		}
+		value := option[2:]
+		if value == "" {
+			i++
+			if i == len(fields) {
+				return nil, fmt.Errorf("%w, missing value after %s", errInvalidForward, option)
+			}
+			value = fields[i]
+		}
+
+		parts := strings.Split(value, ":")
+		if len(parts) == 3 {
+			parts = append([]string{""}, parts...)
+		}
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("%w %q, expected [bind:]port:host:hostport", errInvalidForward, value)
+		}
+		port, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("%w %q, bad port", errInvalidForward, value)
+		}
+		hostPort, err := strconv.Atoi(parts[3])
+		if err != nil {
+			return nil, fmt.Errorf("%w %q, bad host port", errInvalidForward, value)
+		}
+
+		forwards = append(forwards, forward{Direction: option[1:2], Bind: parts[0], Port: port,
+			Host: parts[2], HostPort: hostPort})
+	}
+	return forwards, forwards.validate()
+}
+
+// validate checks the forwards, and fills in the defaults of a local
+// forward to localhost on the device.
+func (specs forwardSpecs) validate() error {
+	seen := make(map[string]bool)
+	for i := range specs {
+		fwd := &specs[i]
+		switch strings.ToLower(fwd.Direction) {
+		case "", "l", "local":
+			fwd.Direction = "L"
+		case "r", "remote":
+			fwd.Direction = "R"
+		default:
+			return fmt.Errorf("%w %s, direction must be local or remote", errInvalidForward, fwd.label())
+		}
+		if fwd.Host == "" {
+			fwd.Host = "localhost"
+		}
+		fwd.Protocol = strings.ToLower(fwd.Protocol)
+
+		if fwd.Port <= 0 || fwd.Port > 65535 {
+			return fmt.Errorf("%w %s, port must be 1-65535", errInvalidForward, fwd.label())
+		}
+		if fwd.HostPort <= 0 || fwd.HostPort > 65535 {
+			return fmt.Errorf("%w %s, host_port must be 1-65535", errInvalidForward, fwd.label())
+		}
+		if strings.ContainsAny(fwd.Bind+fwd.Host, " \t:") {
+			return fmt.Errorf("%w %s, bad bind or host address", errInvalidForward, fwd.label())
+		}
+
+		key := fmt.Sprintf("%s %s:%d", fwd.Direction, fwd.Bind, fwd.Port)
+		if seen[key] {
+			return fmt.Errorf("%w %s, port %d is forwarded twice", errInvalidForward, fwd.label(), fwd.Port)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// label names a forward in messages.
+func (fwd forward) label() string {
+	if fwd.Name != "" {
+		return fmt.Sprintf("%q", fwd.Name)
+	}
+	return strconv.Itoa(fwd.Port)
+}
+
+func (fwd forward) listenAddr() string {
+	bind := fwd.Bind
+	if bind == "" {
+		bind = "localhost"
+	}
+	return net.JoinHostPort(bind, strconv.Itoa(fwd.Port))
+}
+
+func (fwd forward) target() string {
+	return net.JoinHostPort(fwd.Host, strconv.Itoa(fwd.HostPort))
+}
+
+// arg returns the ssh option for the forward.
+func (fwd forward) arg() string {
+	listen := strconv.Itoa(fwd.Port)
+	if fwd.Bind != "" {
+		listen = net.JoinHostPort(fwd.Bind, listen)
+	}
+	return fmt.Sprintf("-%s%s:%s", fwd.Direction, listen, fwd.target())
+}
+
+func (fwd forward) String() string {
+	s := fmt.Sprintf("%s -> device %s", fwd.listenAddr(), fwd.target())
+	if fwd.Direction == "R" {
+		s = fmt.Sprintf("device %s -> %s", fwd.listenAddr(), fwd.target())
+	}
+
+	if fwd.Protocol == "http" || fwd.Protocol == "https" {
+		s += fmt.Sprintf(" (%s://%s/)", fwd.Protocol, fwd.listenAddr())
+	} else if fwd.Protocol != "" {
+		s += fmt.Sprintf(" (%s)", fwd.Protocol)
+	}
+	if fwd.Name != "" {
+		s = fwd.Name + ": " + s
+	}
+	return s
+}
+
+// forwardList returns the forwards for a session to the device: its
+// profile or common forwards, and VNC unless it's disabled or another
+// connection holds it. In loopback mode, local forwards listen on the
+// device's own loopback address, so every device can hold its forwards at
+// once.
+func (dev *Device) forwardList() []forward {
+	var forwards []forward
+	for _, fwd := range dev.forwards() {
+		if fwd.Direction == "L" && fwd.Bind == "" {
+			fwd.Bind = dev.getLoopbackAddr()
+		}
+		forwards = append(forwards, fwd)
+	}
+
+	if _, held := dev.heldVncForward(); dev.vncEnabled() && !held {
+		forwards = append(forwards, dev.vncForward())
+	}
+	return forwards
+}
+
+// forwardHolder returns the connection whose forwards would conflict with
+// a new session to dev. In loopback mode that's only another session to
+// the same device.
+func (dset *DeviceSet) forwardHolder(dev *Device) *Connection {
+	for _, con := range dset.sortedConnections() {
+		if con.forwarded && (con.dev == dev || !config.UseLoopbackAddrs) {
+			return con
+		}
+	}
+	return nil
+}
+
+// forwardTable returns the forwards held by open connections.
+func (dset *DeviceSet) forwardTable() []forwardStatus {
+	table := []forwardStatus{}
+	for _, con := range dset.sortedConnections() {
+		for _, fwd := range con.forwards {
+			table = append(table, forwardStatus{Serial: con.dev.Serial, Connection: con.id, forward: fwd})
+		}
+	}
+	return table
+}
+
+func (dset *DeviceSet) listForwards() {
+	fmt.Print("\nActive forwards:\n")
+	fmt.Printf("serial, connection, forward\n")
+	for _, row := range dset.forwardTable() {
+		fmt.Printf("%s, %d, %s\n", row.Serial, row.Connection, row.forward)
+	}
+}
+
+// controlPath returns the ssh control socket for a session with the given
+// connection id, through which forwards are added and removed while it
+// runs. Windows ssh doesn't support control sockets.
+func controlPath(id int) string {
+	if runtime.GOOS == "windows" {
+		return ""
+	}
+	// Socket paths are limited to about 100 characters, so this is kept
+	// short rather than in the cache directory.
+	return filepath.Join(os.TempDir(), fmt.Sprintf("rdevcon-%d-%d", os.Getpid(), id))
+}
+
+// parseForwardArgs parses the forward given to the forward command, like
+// "8080:80", "-R 9000:9000" or "-L 127.0.0.1:8080:db:5432". The target host
+// defaults to localhost on the device.
+func parseForwardArgs(args []string, bindAddr string) (forward, error) {
+	direction := "-L"
+	if len(args) > 0 && (args[0] == "-L" || args[0] == "-R") {
+		direction, args = args[0], args[1:]
+	}
+	if len(args) != 1 {
+		return forward{}, errors.New("usage: forward 123 [-L|-R] [bind:]port:[host:]hostport")
+	}
+
+	value := args[0]
+	if strings.HasPrefix(value, "-L") || strings.HasPrefix(value, "-R") {
+		direction, value = value[:2], value[2:]
+	}
+	if strings.Count(value, ":") == 1 {
+		port, hostPort, _ := strings.Cut(value, ":")
+		value = port + ":localhost:" + hostPort
+	}
+
+	forwards, err := parseForwards(direction + value)
+	if err != nil {
+		return forward{}, err
+	}
+	fwd := forwards[0]
+	if fwd.Direction == "L" && fwd.Bind == "" {
+		fwd.Bind = bindAddr
+	}
+	return fwd, nil
+}
+
+// session returns the device's ssh session that dynamic forwards are
+// added to: the one holding its forwards, or else the latest one.
+func (dset *DeviceSet) session(dev *Device) (*Connection, error) {
+	var session *Connection
+	for _, con := range dset.sortedConnections() {
+		if con.dev != dev || con.controlPath == "" {
+			continue
+		}
+		if session == nil || !session.forwarded {
+			session = con
+		}
+	}
+	if session == nil {
+		if runtime.GOOS == "windows" {
+			return nil, errors.New("forwards can't be changed on Windows, ssh there doesn't support control sockets")
+		}
+		return nil, fmt.Errorf("no open ssh session to %s, connect first", dev.Serial)
+	}
+	return session, nil
+}
+
+// control asks the session's ssh to forward or cancel a forward.
+func (con *Connection) control(operation string, fwd forward) error {
+	args := strings.Fields(fmt.Sprintf("ssh -S %s -O %s %s -p %d %s@localhost",
+		con.controlPath, operation, fwd.arg(), con.dev.port, con.dev.User))
+	if output, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+		return fmt.Errorf("ssh -O %s: %s", operation, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// addForward forwards a port on the device's open session.
+func (dev *Device) addForward(args []string) error {
+	con, err := dev.parent.session(dev)
+	if err != nil {
+		return err
+	}
+	fwd, err := parseForwardArgs(args, dev.getLoopbackAddr())
+	if err != nil {
+		return err
+	}
+	for _, existing := range con.forwards {
+		if existing.Direction == fwd.Direction && existing.Port == fwd.Port {
+			return fmt.Errorf("connection %d already forwards %s", con.id, existing)
+		}
+	}
+
+	shifted := checkPorts([]forward{fwd})
+	if len(shifted) == 0 {
+		return fmt.Errorf("can't forward %s", fwd.listenAddr())
+	}
+	fwd = shifted[0]
+
+	if err = con.control("forward", fwd); err != nil {
+		return err
+	}
+	con.forwards = append(con.forwards, fwd)
+	con.forwarded = true
+	fmt.Printf("forward: %s on connection %d\n", fwd, con.id)
+	return nil
+}
+
+// removeForward cancels the device's forwards from a port, like "8080", or
+// "-R 9000" for a remote forward.
+func (dev *Device) removeForward(args []string) error {
+	direction := ""
+	if len(args) == 2 && (args[0] == "-L" || args[0] == "-R") {
+		direction, args = args[0][1:], args[1:]
+	}
+	if len(args) != 1 {
+		return errors.New("usage: unforward 123 [-L|-R] port")
+	}
+	port, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid port %q", args[0])
+	}
+
+	removed := 0
+	var errs []error
+	for _, con := range dev.parent.sortedConnections() {
+		if con.dev != dev {
+			continue
+		}
+		var kept []forward
+		for _, fwd := range con.forwards {
+			if fwd.Port != port || (direction != "" && fwd.Direction != direction) {
+				kept = append(kept, fwd)
+				continue
+			}
+			var err error
+			if con.forwardOnly {
+				// The connection exists only for this forward.
+				err = con.close()
+			} else if con.controlPath == "" {
+				err = fmt.Errorf("connection %d can't change its forwards", con.id)
+			} else {
+				err = con.control("cancel", fwd)
+			}
+			if err != nil {
+				errs = append(errs, err)
+				kept = append(kept, fwd)
+				continue
+			}
+			fmt.Printf("removed forward: %s from connection %d\n", fwd, con.id)
+			removed++
+		}
+		con.forwards = kept
+		// A background connection for a single forward never holds the
+		// session's forwards.
+		con.forwarded = len(kept) > 0 && !con.forwardOnly
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return err
+	} else if removed == 0 {
+		return fmt.Errorf("%s has no forward from port %d", dev.Serial, port)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseForwards(t *testing.T) {
+	tests := []struct {
+		options string
+		want    forwardSpecs
+	}{
+		{"", nil},
+		{"-L8080:localhost:80", forwardSpecs{{Direction: "L", Port: 8080, Host: "localhost", HostPort: 80}}},
+		{"-L 8080:db:5432 -R9000:localhost:9000", forwardSpecs{
+			{Direction: "L", Port: 8080, Host: "db", HostPort: 5432},
+			{Direction: "R", Port: 9000, Host: "localhost", HostPort: 9000}}},
+		{"-L127.0.0.1:8080:localhost:80", forwardSpecs{{Direction: "L", Bind: "127.0.0.1", Port: 8080, Host: "localhost", HostPort: 80}}},
+	}
+	for _, test := range tests {
+		got, err := parseForwards(test.options)
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseForwards(%q) = %+v, %v, want %+v", test.options, got, err, test.want)
+		}
+	}
+
+	for _, options := range []string{
+		"-X8080:localhost:80",
+		"8080:localhost:80",
+		"-L",
+		"-L8080:80",
+		"-Lweb:localhost:80",
+		"-L8080:localhost:http",
+		"-L0:localhost:80",
+		"-L8080:localhost:80 -L8080:localhost:81",
+	} {
+		if got, err := parseForwards(options); !errors.Is(err, errInvalidForward) {
+			t.Errorf("parseForwards(%q) = %+v, %v, want an invalid forward", options, got, err)
+		}
+	}
+}
+
+func TestForwardSpecsValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		specs forwardSpecs
+		want  forwardSpecs
+		ok    bool
+	}{
+		{"defaults", forwardSpecs{{Port: 8080, HostPort: 80, Protocol: "HTTP"}},
+			forwardSpecs{{Direction: "L", Port: 8080, Host: "localhost", HostPort: 80, Protocol: "http"}}, true},
+		{"direction names", forwardSpecs{{Direction: "remote", Port: 9000, HostPort: 9000}, {Direction: "local", Port: 9000, HostPort: 9000}},
+			forwardSpecs{{Direction: "R", Port: 9000, Host: "localhost", HostPort: 9000}, {Direction: "L", Port: 9000, Host: "localhost", HostPort: 9000}}, true},
+		{"same port on other binds", forwardSpecs{{Bind: "127.0.0.2", Port: 80, HostPort: 80}, {Bind: "127.0.0.3", Port: 80, HostPort: 80}}, nil, true},
+		{"bad direction", forwardSpecs{{Direction: "up", Port: 8080, HostPort: 80}}, nil, false},
+		{"port out of range", forwardSpecs{{Port: 65536, HostPort: 80}}, nil, false},
+		{"missing host port", forwardSpecs{{Port: 8080}}, nil, false},
+		{"host with port", forwardSpecs{{Port: 8080, Host: "db:5432", HostPort: 5432}}, nil, false},
+		{"duplicate", forwardSpecs{{Port: 8080, HostPort: 80}, {Direction: "L", Port: 8080, HostPort: 81}}, nil, false},
+	}
+	for _, test := range tests {
+		err := test.specs.validate()
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got %v, want ok %v", test.name, err, test.ok)
+		} else if err != nil && !errors.Is(err, errInvalidForward) {
+			t.Errorf("%s: got %v, want an invalid forward", test.name, err)
+		} else if test.want != nil && !reflect.DeepEqual(test.specs, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, test.specs, test.want)
+		}
+	}
+}
+
+func TestForwardSpecsUnmarshal(t *testing.T) {
+	var specs forwardSpecs
+	if err := json.Unmarshal([]byte(`"-L8080:localhost:80"`), &specs); err != nil || len(specs) != 1 || specs[0].Port != 8080 {
+		t.Errorf("string form: got %+v, %v", specs, err)
+	}
+	specs = nil
+	if err := json.Unmarshal([]byte(`[{"name": "web", "port": 8080, "host_port": 80}]`), &specs); err != nil || len(specs) != 1 || specs[0].Name != "web" {
+		t.Errorf("list form: got %+v, %v", specs, err)
+	}
+	if err := json.Unmarshal([]byte(`{"port": 8080}`), &specs); !errors.Is(err, errInvalidForward) {
+		t.Errorf("object: got %v, want an invalid forward", err)
+	}
+}
+
+func TestParseDevicesForwards(t *testing.T) {
+	saved := config
+	config = &Config{PortOffset: 22000}
+	t.Cleanup(func() { config = saved })
+
+	devices, err := parseDevices(`[
+		{"serial": "A", "id": "1", "forwards": "-X8080"},
+		{"serial": "B", "id": "2", "forwards": {"port": 8080}},
+		{"serial": "C", "id": "3", "forwards": [{"port": 8080, "host_port": 80}]},
+		{"serial": "D", "id": "4"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Bad forwards fall back to the common ones, without losing the device
+	// or the ones after it.
+	want := map[string]int{"A": 0, "B": 0, "C": 1, "D": 0}
+	if len(devices) != len(want) {
+		t.Fatalf("got %d devices, want %d", len(devices), len(want))
+	}
+	for _, dev := range devices {
+		if len(dev.Forwards) != want[dev.Serial] {
+			t.Errorf("%s: got forwards %+v", dev.Serial, dev.Forwards)
+		}
+	}
+	if devices[2].port != 22003 {
+		t.Errorf("C: got port %d, want 22003", devices[2].port)
+	}
+}
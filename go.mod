@@ -1,10 +1,14 @@
 module vistapathbio.com/rdevcon
 
-go 1.20
+go 1.22.0
 
 require (
 	github.com/aws/aws-sdk-go v1.49.17
+	golang.org/x/crypto v0.17.0
 	golang.org/x/exp v0.0.0-20241108190413-2d47ceb2692f
 )
 
-require github.com/jmespath/go-jmespath v0.4.0 // indirect
+require (
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	golang.org/x/sys v0.15.0 // indirect
+)
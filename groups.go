@@ -0,0 +1,109 @@
+// Device groups, by allocation or tag, and bulk operations on them.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// inGroup reports whether the device's allocation or one of its tags
+// matches name, ignoring case.
+func (dev *Device) inGroup(name string) bool {
+	if strings.EqualFold(dev.Location, name) {
+		return true
+	}
+	for _, tag := range dev.Tags {
+		if strings.EqualFold(tag, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectDevices resolves "@group" to the visible devices in the group, or
+// anything else to a single device as with find.
+func (dset *DeviceSet) selectDevices(spec string) ([]*Device, error) {
+	if name, isGroup := strings.CutPrefix(spec, "@"); isGroup {
+		var devices []*Device
+		for _, dev := range dset.deviceList {
+			if dev.Hidden && !dset.unlockHidden {
+				continue
+			}
+			if dev.inGroup(name) {
+				devices = append(devices, dev)
+			}
+		}
+		if len(devices) == 0 {
+			return nil, fmt.Errorf("%w in group %s", errUnknownDevice, name)
+		}
+		return devices, nil
+	}
+
+	dev := dset.find(spec)
+	if dev == nil {
+		return nil, fmt.Errorf("%w: %s", errUnknownDevice, spec)
+	}
+	return []*Device{dev}, nil
+}
+
+// listGroup prints the devices in a group.
+func (dset *DeviceSet) listGroup(name string) error {
+	devices, err := dset.selectDevices("@" + name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("\nGroup %s:\n", name)
+	for _, dev := range devices {
+		fmt.Printf("%s, %4d, %s, (%s)\n", dev.Serial, dev.offset, dev.Location, dev.Comment)
+	}
+	return nil
+}
+
+// listGroups prints every allocation and tag with the number of visible
+// devices in it.
+func (dset *DeviceSet) listGroups() {
+	counts := make(map[string]int)
+	for _, dev := range dset.deviceList {
+		if dev.Hidden && !dset.unlockHidden {
+			continue
+		}
+		names := append([]string{dev.Location}, dev.Tags...)
+		for _, name := range names {
+			if name != "" {
+				counts[name]++
+			}
+		}
+	}
+
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Print("\nGroups:\n")
+	for _, name := range names {
+		fmt.Printf("@%s (%d)\n", name, counts[name])
+	}
+}
+
+// forEach runs action on every selected device, carrying on past
+// failures, and returns the errors joined together.
+func (dset *DeviceSet) forEach(spec string, action func(dev *Device) error) error {
+	devices, err := dset.selectDevices(spec)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, dev := range devices {
+		if err := action(dev); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", dev.Serial, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,203 @@
+// Device host key pinning. Every device is reached at localhost, so instead
+// of ssh's own known_hosts rdevcon keeps a known_hosts file where each
+// device's key is stored under its serial, and ssh is pointed at it with
+// HostKeyAlias.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const hostKeyTimeout = 10 * time.Second
+
+// knownHostsPath returns rdevcon's known_hosts file for devices.
+func knownHostsPath() string {
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".ssh", "rdevcon_known_hosts")
+}
+
+// hostKeyOptions returns the ssh options that check the device against its
+// pinned key. Keys are only ever added by rdevcon, see verifyHostKey.
+func (dev *Device) hostKeyOptions() string {
+	return fmt.Sprintf("-o HostKeyAlias=%s -o UserKnownHostsFile=%s -o StrictHostKeyChecking=yes -o UpdateHostKeys=no",
+		dev.Serial, knownHostsPath())
+}
+
+// knownHostKeys returns the keys pinned for a device serial.
+func knownHostKeys(serial string) ([]ssh.PublicKey, error) {
+	data, err := os.ReadFile(knownHostsPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var keys []ssh.PublicKey
+	for len(data) > 0 {
+		marker, hosts, key, _, rest, err := ssh.ParseKnownHosts(data)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %w", knownHostsPath(), err)
+		}
+		data = rest
+		if marker == "" && slices.Contains(hosts, serial) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// fetchHostKey does just enough of an ssh handshake with the device, through
+// the hub, to learn its host key. algorithms limits the key types offered,
+// so that a device with a pinned key is asked for that type of key.
+func (dev *Device) fetchHostKey(algorithms []string) (ssh.PublicKey, error) {
+	client, err := tunnels.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := client.Dial("tcp", net.JoinHostPort("localhost", strconv.Itoa(dev.port)))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// ssh channels don't support deadlines, as in probeBanner.
+	timer := time.AfterFunc(hostKeyTimeout, func() { conn.Close() })
+	defer timer.Stop()
+
+	var hostKey ssh.PublicKey
+	clientConfig := &ssh.ClientConfig{
+		User:              dev.User,
+		HostKeyAlgorithms: algorithms,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKey = key
+			return errors.New("host key received")
+		},
+	}
+	ssh.NewClientConn(conn, dev.Serial, clientConfig)
+
+	if hostKey == nil {
+		return nil, fmt.Errorf("no host key from %s", dev.Serial)
+	}
+	return hostKey, nil
+}
+
+// keyAlgorithms returns the host key algorithms that produce keys of the
+// given types.
+func keyAlgorithms(keys []ssh.PublicKey) []string {
+	var algorithms []string
+	for _, key := range keys {
+		if key.Type() == ssh.KeyAlgoRSA {
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		} else {
+			algorithms = append(algorithms, key.Type())
+		}
+	}
+	return algorithms
+}
+
+// verifyHostKey checks the device's host key against the pinned one, once
+// per session. A device seen for the first time is trusted and its key
+// pinned. A changed key is refused until the user runs rekey.
+func (dev *Device) verifyHostKey() error {
+	if dev.hostKeyChecked {
+		return nil
+	}
+
+	known, err := knownHostKeys(dev.Serial)
+	if err != nil {
+		return err
+	}
+
+	key, err := dev.fetchHostKey(keyAlgorithms(known))
+	if err != nil {
+		return fmt.Errorf("host key: %w", err)
+	}
+
+	if len(known) == 0 {
+		if err = addHostKey(dev.Serial, key); err != nil {
+			return err
+		}
+		fmt.Printf("*** first connection to %s, trusting its %s host key %s\n",
+			dev.Serial, key.Type(), ssh.FingerprintSHA256(key))
+	} else if !slices.ContainsFunc(known, func(k ssh.PublicKey) bool { return bytes.Equal(k.Marshal(), key.Marshal()) }) {
+		return fmt.Errorf("*** host key for %s has changed to %s, refusing to connect (if the device was reinstalled, run: rekey %s)",
+			dev.Serial, ssh.FingerprintSHA256(key), dev.Serial)
+	}
+
+	dev.hostKeyChecked = true
+	return nil
+}
+
+// addHostKey pins a key for a device serial.
+func addHostKey(serial string, key ssh.PublicKey) error {
+	path := knownHostsPath()
+	os.MkdirAll(filepath.Dir(path), 0700)
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = fmt.Fprintln(file, knownhosts.Line([]string{serial}, key))
+	return err
+}
+
+// removeHostKeys forgets the pinned keys for a device serial, and returns
+// how many were removed.
+func removeHostKeys(serial string) (int, error) {
+	path := knownHostsPath()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	var kept []string
+	removed := 0
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && !strings.HasPrefix(fields[0], "#") &&
+			slices.Contains(strings.Split(fields[0], ","), serial) {
+			removed++
+			continue
+		}
+		kept = append(kept, line)
+	}
+
+	if removed > 0 {
+		if err = os.WriteFile(path, []byte(strings.Join(kept, "")), 0600); err != nil {
+			return 0, err
+		}
+	}
+	return removed, nil
+}
+
+// rekey replaces the device's pinned host key with the one it presents now.
+func (dev *Device) rekey() error {
+	removed, err := removeHostKeys(dev.Serial)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Removed %d host key(s) for %s from %s\n", removed, dev.Serial, knownHostsPath())
+
+	dev.hostKeyChecked = false
+	return dev.tunnelSetup()
+}
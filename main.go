@@ -5,10 +5,13 @@ package main
 import (
 	"bufio"
 	_ "embed"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"os/exec"
 	"runtime"
+	"slices"
 	"strings"
 	"time"
 )
@@ -16,6 +19,9 @@ import (
 //go:embed devices.json
 var device_database string
 
+// Release version, set at build time with -ldflags "-X main.version=1.2.3".
+var version = "dev"
+
 func systemOk() bool {
 	var err error
 
@@ -70,43 +76,226 @@ func help() {
 	fmt.Println("23080123T - connect to device with serial 23080123T")
 	fmt.Println("22123! - connect to device with tunnel port 22123 (for unlisted devices)")
 	fmt.Println("list - list devices")
+	fmt.Println("list online - list devices connected to the hub (also list offline)")
+	fmt.Println("probe - check which devices are connected to the hub (also probe 123, probe @lab-a)")
+	fmt.Println("groups - list device groups (allocations and tags)")
+	fmt.Println("group lab-a - list devices with allocation or tag lab-a")
+	fmt.Println("connect @lab-a - connect to every device in group lab-a (also connect 123)")
+	fmt.Println("mount @lab-a - sshfs mount every device in group lab-a (also mount 123)")
+	fmt.Println("run @lab-a uptime - run a command on every device in group lab-a (also run 123 ..., run -help for options)")
+	fmt.Println("connections - list active connections")
+	fmt.Println("forwards - list port forwards held by connections")
+	fmt.Println("forward 123 8080:80 - forward local port 8080 to port 80 on device 123's open session (also -R 9000:9000)")
+	fmt.Println("unforward 123 8080 - remove the forward from port 8080 on device 123 (also -R 9000)")
+	fmt.Println("vnc 123 - forward the VNC server of device 123 if needed, and open a viewer on it")
+	fmt.Println("close 7 - close connection with id 7 (unmounts sshfs mounts)")
+	fmt.Println("disconnect 123 - close tunnel to device 123 (or @lab-a), with all its connections and mounts")
 	fmt.Println("unlock-hidden -  unhide prod and demo devices (speedbump)")
 	fmt.Println("lock-hidden - hide prod and demo devices (speedbump)")
 	fmt.Println("loopback - toggle use of loopback addresses for port forwards")
+	fmt.Println("rekey 123 - forget the pinned host key of device 123 and trust the one it has now")
+	fmt.Println("reload - fetch the device database again, keeping connections to devices still listed")
+	fmt.Println("ssh-config - write ssh config for all devices to ~/.ssh/rdevcon_config (or a given file)")
+	fmt.Println("version - show rdevcon version")
+	fmt.Println("update - install the latest release (also update --channel beta, update --allow-downgrade)")
+	fmt.Println("rollback - go back to the version before the last update")
+	fmt.Println("web - show web dashboard and API address")
 	fmt.Println("help - this help")
 	fmt.Println("exit - exit program")
 	fmt.Println("exit!- exit program even if clean exit conditions aren't met (also ctrl-d or ctrl-z)")
 }
 
-func main() {
-	config = ConfigLoad()
+var errUnknownDevice = errors.New("no such device")
+var errUnknownConnection = errors.New("no such connection")
 
-	// Pass certain args along to ssh commands.
+// handleCommand runs one command from the prompt or the web interface,
+// and returns any error for the caller to report.
+func handleCommand(allDevices *DeviceSet, input string, done *bool) error {
+	ilen := len(input)
+	fields := strings.Fields(input)
+	if ilen == 0 {
+	} else if input == "exit" {
+		checkExitConditions(done)
+	} else if input == "exit!" {
+		*done = true
+	} else if fields[0] == "list" && len(fields) <= 2 {
+		return allDevices.list(strings.TrimSpace(input[len("list"):]))
+	} else if fields[0] == "probe" && len(fields) <= 2 {
+		devices := allDevices.visible()
+		if len(fields) == 2 {
+			var err error
+			if devices, err = allDevices.selectDevices(fields[1]); err != nil {
+				return err
+			}
+		}
+		if err := allDevices.probe(devices); err != nil {
+			return err
+		}
+		return allDevices.list("")
+	} else if input == "connections" {
+		allDevices.listConnections()
+	} else if input == "forwards" {
+		allDevices.listForwards()
+	} else if fields[0] == "forward" && len(fields) >= 3 {
+		dev := allDevices.find(fields[1])
+		if dev == nil {
+			return fmt.Errorf("%w: %s", errUnknownDevice, fields[1])
+		}
+		return dev.addForward(fields[2:])
+	} else if fields[0] == "unforward" && len(fields) >= 3 {
+		dev := allDevices.find(fields[1])
+		if dev == nil {
+			return fmt.Errorf("%w: %s", errUnknownDevice, fields[1])
+		}
+		return dev.removeForward(fields[2:])
+	} else if fields[0] == "vnc" && len(fields) == 2 {
+		dev := allDevices.find(fields[1])
+		if dev == nil {
+			return fmt.Errorf("%w: %s", errUnknownDevice, fields[1])
+		}
+		return dev.vnc()
+	} else if fields[0] == "close" && len(fields) == 2 {
+		con := allDevices.findConnection(atoi(fields[1]))
+		if con == nil {
+			return fmt.Errorf("%w: %s", errUnknownConnection, fields[1])
+		}
+		return con.close()
+	} else if fields[0] == "disconnect" && len(fields) == 2 {
+		return allDevices.forEach(fields[1], func(dev *Device) error {
+			dev.disconnect()
+			return nil
+		})
+	} else if fields[0] == "rekey" && len(fields) == 2 {
+		return allDevices.forEach(fields[1], (*Device).rekey)
+	} else if input == "reload" {
+		_, err := allDevices.reload(false)
+		return err
+	} else if fields[0] == "ssh-config" && len(fields) <= 2 {
+		path := sshConfigPath()
+		if len(fields) == 2 {
+			path = fields[1]
+		}
+		return allDevices.writeSshConfig(path, false)
+	} else if input == "groups" {
+		allDevices.listGroups()
+	} else if fields[0] == "group" && len(fields) == 2 {
+		return allDevices.listGroup(fields[1])
+	} else if fields[0] == "connect" && len(fields) == 2 {
+		return allDevices.forEach(fields[1], (*Device).connect)
+	} else if fields[0] == "mount" && len(fields) == 2 {
+		return allDevices.forEach(fields[1], (*Device).mount)
+	} else if fields[0] == "run" {
+		opts, spec, command, err := parseRunArgs(fields[1:])
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		_, err = allDevices.runCommand(opts, spec, command)
+		return err
+	} else if input == "unlock-hidden" {
+		allDevices.unlockHidden = true
+	} else if input == "lock-hidden" {
+		allDevices.unlockHidden = false
+	} else if input == "loopback" {
+		setLoopback(!config.UseLoopbackAddrs)
+	} else if fields[0] == "update" {
+		opts, err := parseUpdateArgs(fields[1:])
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		installed, err := selfUpdate(opts)
+		if installed {
+			fmt.Println("Update installed, restart rdevcon to use it.")
+		}
+		return err
+	} else if input == "rollback" {
+		return rollback()
+	} else if input == "version" {
+		fmt.Printf("rdevcon version %s\n", version)
+	} else if input == "web" {
+		webShow()
+	} else if input == "help" {
+		help()
+	} else if input[ilen-1:] == "~" {
+		dev := allDevices.find(input[:ilen-1])
+		if dev == nil {
+			return fmt.Errorf("%w: %s", errUnknownDevice, input[:ilen-1])
+		}
+		return dev.mount()
+	} else if dev := allDevices.find(input); dev != nil {
+		return dev.connect()
+	} else {
+		return fmt.Errorf("%w: %s", errUnknownDevice, input)
+	}
+	return nil
+}
+
+func main() {
+	// Pass certain args along to ssh commands, and collect the rest
+	// for subcommands. Everything after "--" is left to the subcommand.
+	verbose := false
+	sshOptionList := []string{}
 	optNext := ""
-	for _, arg := range os.Args {
-		if arg == "-v" {
-			config.Verbose = true
+	args := []string{}
+	for i, arg := range os.Args[1:] {
+		if arg == "--" {
+			args = append(args, os.Args[i+1:]...)
+			break
+		} else if arg == "-v" {
+			verbose = true
 		} else if len(arg) == 2 && arg[0:1] == "-" && strings.Index("iIo", arg[1:]) >= 0 {
 			optNext = arg
 			continue
 		} else if optNext != "" {
-			config.SshOptionList = append(config.SshOptionList, fmt.Sprintf("%s %s\n", optNext, arg))
+			sshOptionList = append(sshOptionList, fmt.Sprintf("%s %s\n", optNext, arg))
+		} else {
+			args = append(args, arg)
 		}
 		optNext = ""
 	}
 
+	// Subcommand output may be read by scripts, so startup messages go
+	// to stderr instead.
+	stdout := os.Stdout
+	if len(args) > 0 {
+		os.Stdout = os.Stderr
+	}
+
+	config = ConfigLoad()
+	config.Verbose = config.Verbose || verbose
+	config.SshOptionList = append(config.SshOptionList, sshOptionList...)
+
+	fmt.Printf("rdevcon version %s\n", version)
+
 	awsSetup()
 
-	checkForUpdates()
+	// Subcommands that manage versions do their own update checks.
+	if len(args) == 0 || !slices.Contains([]string{"update", "rollback", "version", "release"}, args[0]) {
+		checkForUpdates()
+	}
 
 	if !systemOk() {
+		if len(args) > 0 {
+			os.Exit(1)
+		}
 		fmt.Print("Press Enter to continue...")
 		fmt.Scanln()
 		return
 	}
 
 	allDevices := loadDevices()
-	allDevices.list()
+
+	if len(args) > 0 {
+		os.Stdout = stdout
+		os.Exit(cliMain(allDevices, args))
+	}
+
+	webCalls := webStart(allDevices)
+	reloadTicks := reloadTimer()
+	allDevices.list("")
 	help()
 	fmt.Print("> ")
 
@@ -130,49 +319,35 @@ func main() {
 		}
 	}()
 
-	handleCommand := func(input string, done *bool) {
-		ilen := len(input)
-		if ilen == 0 {
-		} else if input == "exit" {
-			checkExitConditions(done)
-		} else if input == "exit!" {
-			*done = true
-		} else if input == "list" {
-			allDevices.list()
-		} else if input == "unlock-hidden" {
-			allDevices.unlockHidden = true
-		} else if input == "lock-hidden" {
-			allDevices.unlockHidden = false
-		} else if input == "loopback" {
-			setLoopback(!config.UseLoopbackAddrs)
-		} else if input == "help" {
-			help()
-		} else if input[ilen-1:] == "~" {
-			if dev := allDevices.find(input[:ilen-1]); dev != nil {
-				dev.mount()
-			}
-		} else if dev := allDevices.find(input); dev != nil {
-			dev.connect()
-		}
-		if !*done {
-			fmt.Print("> ")
-		}
-	}
-
 	for {
-		// Main loop servicing command-line (and TBD http) requests.
+		// Main loop servicing command-line and http requests.
 		// To avoid race conditions, limit state changes to synchronous
 		// function calls from this loop.
 		done := false
 		select {
 		case input := <-command:
-			handleCommand(input, &done)
+			if err := handleCommand(allDevices, input, &done); err != nil {
+				fmt.Println(err)
+			}
+			if !done {
+				fmt.Print("> ")
+			}
+		case call := <-webCalls:
+			call()
+		case <-reloadTicks:
+			if reported, err := allDevices.reload(true); err != nil {
+				fmt.Printf("\nreload: %v\n> ", err)
+			} else if reported {
+				fmt.Print("> ")
+			}
 		case _ = <-time.After(1 * time.Second):
 			// fmt.Println("timeout")
 		case dev := <-allDevices.tunnelFinish:
-			// Explicitly close/kill all connections supported by tunnel.
-			// TBD for now, needs testing.
-			dev = dev
+			// The tunnel supervisor gave up on this device, so
+			// explicitly close/kill all connections supported by tunnel.
+			fmt.Printf("\ntunnel for %s closed: %s\n", dev.Serial, tunnels.state(dev))
+			allDevices.teardown(dev)
+			fmt.Print("> ")
 		case con := <-allDevices.connectionFinish:
 			// Remove from connection set.
 			delete(allDevices.connections, con)
@@ -185,9 +360,5 @@ func main() {
 
 	loopbackCleanup()
 
-	for _, dev := range allDevices.deviceList {
-		if dev.tunnelCmd != nil {
-			dev.tunnelCmd.Process.Kill()
-		}
-	}
+	tunnels.closeAll()
 }
@@ -0,0 +1,116 @@
+// Local port conflict detection for forwards.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// How far past a taken port AutoShiftPorts looks for a free one.
+const portShiftRange = 100
+
+// portFree reports whether a forward could listen on addr.
+func portFree(addr string) bool {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return false
+	}
+	listener.Close()
+	return true
+}
+
+// portHolder describes the process listening on a local port, or returns
+// "" if it can't be found out.
+func portHolder(port int) string {
+	if runtime.GOOS == "windows" {
+		output, err := exec.Command("netstat", "-ano", "-p", "TCP").Output()
+		if err != nil {
+			return ""
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(output))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 5 && fields[3] == "LISTENING" && strings.HasSuffix(fields[1], ":"+strconv.Itoa(port)) {
+				return "pid " + fields[4]
+			}
+		}
+		return ""
+	}
+
+	output, err := exec.Command("lsof", "-nP", fmt.Sprintf("-iTCP:%d", port), "-sTCP:LISTEN", "-Fpc").Output()
+	if err != nil {
+		return ""
+	}
+	var pid, command string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() && (pid == "" || command == "") {
+		line := scanner.Text()
+		if value, ok := strings.CutPrefix(line, "p"); ok && pid == "" {
+			pid = value
+		} else if value, ok := strings.CutPrefix(line, "c"); ok && command == "" {
+			command = value
+		}
+	}
+	if pid == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s (pid %s)", command, pid)
+}
+
+// checkPorts checks that every local forward can listen on its port, and
+// reports the ones that can't along with what holds the port. With
+// AutoShiftPorts, those are moved to the next free port, otherwise they
+// are left out. It returns the forwards to use.
+func checkPorts(forwards []forward) []forward {
+	var usable []forward
+	for _, fwd := range forwards {
+		if fwd.Direction != "L" || portFree(fwd.listenAddr()) {
+			usable = append(usable, fwd)
+			continue
+		}
+
+		taken := fmt.Sprintf("*** %s is in use", fwd.listenAddr())
+		if fwd.Name != "" {
+			taken = fmt.Sprintf("*** %s: %s is in use", fwd.Name, fwd.listenAddr())
+		}
+		if holder := portHolder(fwd.Port); holder != "" {
+			taken += " by " + holder
+		}
+
+		if !config.AutoShiftPorts {
+			fmt.Printf("%s, not forwarding it (set AutoShiftPorts to use a free port)\n", taken)
+			continue
+		}
+
+		shifted := fwd
+		for shifted.Port = fwd.Port + 1; shifted.Port <= fwd.Port+portShiftRange && shifted.Port <= 65535; shifted.Port++ {
+			if portFree(shifted.listenAddr()) && !forwardsPort(forwards, shifted) && !forwardsPort(usable, shifted) {
+				break
+			}
+		}
+		if shifted.Port > fwd.Port+portShiftRange || shifted.Port > 65535 {
+			fmt.Printf("%s, and no free port found near it, not forwarding it\n", taken)
+			continue
+		}
+		fmt.Printf("%s, forwarding %s instead\n", taken, shifted.listenAddr())
+		usable = append(usable, shifted)
+	}
+	return usable
+}
+
+// forwardsPort reports whether one of the forwards listens where fwd does.
+func forwardsPort(forwards []forward, fwd forward) bool {
+	for _, other := range forwards {
+		if other.Direction == fwd.Direction && other.Bind == fwd.Bind && other.Port == fwd.Port {
+			return true
+		}
+	}
+	return false
+}
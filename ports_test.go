@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// takenPort listens on a free loopback port for the rest of the test.
+func takenPort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestCheckPorts(t *testing.T) {
+	saved := config
+	config = &Config{}
+	t.Cleanup(func() { config = saved })
+
+	port := takenPort(t)
+	taken := forward{Name: "web", Direction: "L", Bind: "127.0.0.1", Port: port, Host: "localhost", HostPort: 80}
+	next := forward{Direction: "L", Bind: "127.0.0.1", Port: port + 1, Host: "localhost", HostPort: 81}
+	remote := forward{Direction: "R", Port: port, Host: "localhost", HostPort: 9000}
+
+	// Without AutoShiftPorts, a taken port is left out, and remote forwards
+	// aren't checked.
+	usable := checkPorts([]forward{taken, remote})
+	if len(usable) != 1 || usable[0] != remote {
+		t.Errorf("without AutoShiftPorts: got %+v, want only the remote forward", usable)
+	}
+
+	// With it, the taken port moves past the ports other forwards use.
+	config.AutoShiftPorts = true
+	usable = checkPorts([]forward{taken, next})
+	if len(usable) != 2 {
+		t.Fatalf("with AutoShiftPorts: got %+v, want both forwards", usable)
+	}
+	shifted := usable[0]
+	if shifted.Port <= port+1 || shifted.Port > port+portShiftRange {
+		t.Errorf("shifted to port %d, want %d-%d", shifted.Port, port+2, port+portShiftRange)
+	}
+	if shifted.Name != taken.Name || shifted.HostPort != taken.HostPort {
+		t.Errorf("shifted forward %+v lost its target", shifted)
+	}
+	if !portFree(shifted.listenAddr()) {
+		t.Errorf("shifted to %s, which isn't free", shifted.listenAddr())
+	}
+	if usable[1] != next {
+		t.Errorf("got %+v, want %+v unchanged", usable[1], next)
+	}
+}
+
+func TestForwardsPort(t *testing.T) {
+	forwards := []forward{
+		{Direction: "L", Bind: "127.0.0.1", Port: 8080},
+		{Direction: "R", Port: 9000},
+	}
+	tests := []struct {
+		fwd  forward
+		want bool
+	}{
+		{forward{Direction: "L", Bind: "127.0.0.1", Port: 8080}, true},
+		{forward{Direction: "L", Bind: "127.0.0.2", Port: 8080}, false},
+		{forward{Direction: "R", Port: 8080}, false},
+		{forward{Direction: "R", Port: 9000}, true},
+	}
+	for _, test := range tests {
+		if got := forwardsPort(forwards, test.fwd); got != test.want {
+			t.Errorf("forwardsPort(%+v) = %v, want %v", test.fwd, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Device liveness probing through the hub.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	probeTimeout  = 5 * time.Second
+	probeParallel = 16
+	probeMaxAge   = 60 * time.Second
+)
+
+// Result of the last probe of a device. Only updated from the main loop.
+type probeResult struct {
+	checked  time.Time
+	online   bool
+	lastSeen time.Time
+	reason   string
+}
+
+// probeBanner connects to the device's reverse port on the hub, and checks
+// that an ssh server answers with its banner.
+func probeBanner(dial func(network, addr string) (net.Conn, error), port int) error {
+	conn, err := dial("tcp", net.JoinHostPort("localhost", strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// ssh channels don't support deadlines, so closing the connection is
+	// what ends a read that takes too long.
+	timer := time.AfterFunc(probeTimeout, func() { conn.Close() })
+	defer timer.Stop()
+
+	banner, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("no ssh banner: %w", err)
+	}
+	if !strings.HasPrefix(banner, "SSH-") {
+		return fmt.Errorf("unexpected banner %q", strings.TrimSpace(banner))
+	}
+	return nil
+}
+
+// probe checks the devices concurrently over the hub connection, and
+// caches the results on each device.
+func (dset *DeviceSet) probe(devices []*Device) error {
+	client, err := tunnels.connect()
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, len(devices))
+	var wg sync.WaitGroup
+	slots := make(chan bool, probeParallel)
+	for i, dev := range devices {
+		wg.Add(1)
+		go func(i int, port int) {
+			defer wg.Done()
+			slots <- true
+			defer func() { <-slots }()
+			errs[i] = probeBanner(client.Dial, port)
+		}(i, dev.port)
+	}
+	wg.Wait()
+
+	now := time.Now()
+	for i, dev := range devices {
+		dev.probe.checked = now
+		dev.probe.online = errs[i] == nil
+		if dev.probe.online {
+			dev.probe.lastSeen = now
+			dev.probe.reason = ""
+		} else {
+			dev.probe.reason = errs[i].Error()
+		}
+	}
+	return nil
+}
+
+// probeStale probes the visible devices if any result is older than
+// probeMaxAge.
+func (dset *DeviceSet) probeStale() error {
+	devices := dset.visible()
+	for _, dev := range devices {
+		if time.Since(dev.probe.checked) > probeMaxAge {
+			return dset.probe(devices)
+		}
+	}
+	return nil
+}
+
+// onlineStatus describes the last probe result, "-" if never probed.
+func (dev *Device) onlineStatus() string {
+	if dev.probe.checked.IsZero() {
+		return "-"
+	} else if dev.probe.online {
+		return "online"
+	} else if !dev.probe.lastSeen.IsZero() {
+		return fmt.Sprintf("offline (last seen %s)", dev.probe.lastSeen.Format("2006-01-02 15:04:05"))
+	}
+	return "offline"
+}
@@ -0,0 +1,88 @@
+// Per-device connection profiles, merged over the global config.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// forwards returns the device's forward specifications, which replace the
+// common forwards if set.
+func (dev *Device) forwards() forwardSpecs {
+	if dev.Forwards != nil {
+		return dev.Forwards
+	}
+	return config.Forwards
+}
+
+// sshOptions returns the global ssh options followed by the device's own.
+func (dev *Device) sshOptions() string {
+	options := config.sshOptions()
+	for _, option := range dev.SshOptions {
+		options += " " + option
+	}
+	return options
+}
+
+// shell returns the command run for interactive sessions.
+func (dev *Device) shell() string {
+	if dev.Shell != "" {
+		return dev.Shell
+	} else if config.Shell != "" {
+		return config.Shell
+	}
+	return "bash -l"
+}
+
+// envVars returns the global and device environment variables as
+// " NAME=value" pairs for the ssh command line, with device values taking
+// precedence. Values containing whitespace can't be passed this way, and
+// are skipped.
+func (dev *Device) envVars() string {
+	env := make(map[string]string)
+	for name, value := range config.Env {
+		env[name] = value
+	}
+	for name, value := range dev.Env {
+		env[name] = value
+	}
+
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	env_vars := ""
+	for _, name := range names {
+		if strings.ContainsAny(env[name], " \t\n") {
+			fmt.Printf("*** not passing %s, value contains whitespace\n", name)
+			continue
+		}
+		env_vars += fmt.Sprintf(" %s=%s", name, env[name])
+	}
+	return env_vars
+}
+
+// sshfsRoot returns the remote directory to mount.
+func (dev *Device) sshfsRoot() string {
+	if dev.SshfsRoot != "" {
+		return dev.SshfsRoot
+	} else if config.SshfsRoot != "" {
+		return config.SshfsRoot
+	}
+	return "/"
+}
+
+// vncPort returns the device-side VNC port. By default each device is
+// assumed to run its VNC server at 5900 plus its offset.
+func (dev *Device) vncPort() int {
+	if dev.VncPort != 0 {
+		return dev.VncPort
+	} else if config.VncPort != 0 {
+		return config.VncPort
+	}
+	return dev.offset + 5900
+}
@@ -0,0 +1,136 @@
+// Release signing, for publishing self-updates. See updates.go.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func releaseUsage() {
+	fmt.Println("usage: rdevcon release keygen <keyfile>")
+	fmt.Println("       rdevcon release sign --key <keyfile> --version <version> [--channel name] [--notes text] <binary>")
+}
+
+func cliRelease(args []string) error {
+	if len(args) == 0 {
+		releaseUsage()
+		return flag.ErrHelp
+	}
+
+	switch args[0] {
+	case "keygen":
+		if len(args) != 2 {
+			releaseUsage()
+			return errors.New("release keygen: key file required")
+		}
+		return releaseKeygen(args[1])
+	case "sign":
+		flags := flag.NewFlagSet("release sign", flag.ContinueOnError)
+		keyPath := flags.String("key", "", "release signing key file")
+		manifest := updateManifest{}
+		flags.StringVar(&manifest.Version, "version", "", "release version, like 1.2.3 or 1.3.0-beta.1")
+		flags.StringVar(&manifest.Channel, "channel", "stable", "release channel, like stable or beta")
+		flags.StringVar(&manifest.Notes, "notes", "", "release notes")
+		positional, err := parseArgs(flags, args[1:])
+		if err != nil {
+			return err
+		}
+		if *keyPath == "" || len(positional) != 1 {
+			releaseUsage()
+			return errors.New("release sign: key file and binary required")
+		}
+		if _, ok := parseVersion(manifest.Version); !ok {
+			return fmt.Errorf("release sign: invalid version %q", manifest.Version)
+		}
+		return releaseSign(*keyPath, positional[0], manifest)
+	default:
+		releaseUsage()
+		return flag.ErrHelp
+	}
+}
+
+// releaseKeygen creates a release signing key, and prints the public key
+// to compile in as UpdatePublicKey.
+func releaseKeygen(keyPath string) error {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(keyPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err = fmt.Fprintln(file, base64.StdEncoding.EncodeToString(privateKey.Seed())); err != nil {
+		return err
+	}
+
+	fmt.Printf("Wrote release signing key to %s, keep it secret.\n", keyPath)
+	fmt.Printf("Add this to config.json before building:\n")
+	fmt.Printf("\"UpdatePublicKey\": \"%s\"\n", base64.StdEncoding.EncodeToString(publicKey))
+	return nil
+}
+
+func loadReleaseKey(keyPath string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s is not a release signing key", keyPath)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// releaseSign writes the signed manifest for a binary, next to it. The
+// manifest's version, channel and notes are filled in by the caller.
+func releaseSign(keyPath string, binaryPath string, manifest updateManifest) error {
+	privateKey, err := loadReleaseKey(keyPath)
+	if err != nil {
+		return err
+	}
+
+	binary, err := os.ReadFile(binaryPath)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(binary)
+	manifest.SHA256 = hex.EncodeToString(sum[:])
+	manifest.Size = len(binary)
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, data))
+
+	if err = os.WriteFile(binaryPath+".manifest", data, 0644); err != nil {
+		return err
+	}
+	if err = os.WriteFile(binaryPath+".manifest.sig", []byte(signature+"\n"), 0644); err != nil {
+		return err
+	}
+
+	fmt.Printf("Wrote %s.manifest and %s.manifest.sig\n", binaryPath, binaryPath)
+	target := "SelfUpdatePath"
+	if manifest.Channel != "stable" {
+		target += "-" + manifest.Channel
+	}
+	fmt.Printf("Upload all three files to %s, with the same base name.\n", target)
+	return nil
+}
@@ -0,0 +1,155 @@
+// Reloading the device database while running.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// reloadTimer returns a channel that fires every ReloadInterval seconds, or
+// nil if periodic reloads are disabled, which never fires in a select.
+func reloadTimer() <-chan time.Time {
+	if config.ReloadInterval <= 0 || config.DevicesPath == "" {
+		return nil
+	}
+	return time.NewTicker(time.Duration(config.ReloadInterval) * time.Second).C
+}
+
+// deviceChanges returns the json names of the database fields that differ
+// between two versions of a device.
+func deviceChanges(old *Device, updated *Device) []string {
+	var changed []string
+	oldValue, updatedValue := reflect.ValueOf(old).Elem(), reflect.ValueOf(updated).Elem()
+	for _, field := range reflect.VisibleFields(oldValue.Type()) {
+		if !field.IsExported() {
+			continue
+		}
+		if !reflect.DeepEqual(oldValue.FieldByIndex(field.Index).Interface(), updatedValue.FieldByIndex(field.Index).Interface()) {
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// update copies the database fields of updated into dev, leaving its
+// session state alone.
+func (dev *Device) update(updated *Device) {
+	devValue, updatedValue := reflect.ValueOf(dev).Elem(), reflect.ValueOf(updated).Elem()
+	for _, field := range reflect.VisibleFields(devValue.Type()) {
+		if field.IsExported() {
+			devValue.FieldByIndex(field.Index).Set(updatedValue.FieldByIndex(field.Index))
+		}
+	}
+	dev.offset = updated.offset
+	dev.port = updated.port
+}
+
+// inUse reports whether the device has a tunnel or connections.
+func (dev *Device) inUse() bool {
+	if tunnels.state(dev) != "" {
+		return true
+	}
+	for con := range dev.parent.connections {
+		if con.dev == dev {
+			return true
+		}
+	}
+	return false
+}
+
+// reload fetches the device database again and applies it to the set.
+// Devices that are still listed keep their tunnels and connections, removed
+// devices are disconnected. Anonymous devices aren't in the database and
+// are kept. Changes are printed, and with quiet, nothing is printed if there
+// are none. It returns whether anything was printed.
+func (dset *DeviceSet) reload(quiet bool) (bool, error) {
+	if config.DevicesPath == "" {
+		return false, errors.New("no DevicesPath configured, nothing to reload")
+	}
+
+	database, staleSince, err := fetchDeviceDatabase()
+	if err != nil {
+		return false, err
+	}
+	devices, err := parseDevices(database)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", config.DevicesPath, err)
+	}
+
+	var deviceList []*Device
+	devicesBySerial := make(map[string]*Device)
+	var diff []string
+	added, removed, changed := 0, 0, 0
+
+	for _, updated := range devices {
+		if _, duplicate := devicesBySerial[updated.Serial]; duplicate {
+			continue
+		}
+
+		dev, exists := dset.devicesBySerial[updated.Serial]
+		if !exists || dev.ID == "" {
+			updated.parent = dset
+			dev = updated
+			added++
+			diff = append(diff, fmt.Sprintf("+ %s (id %d)", dev.Serial, dev.offset))
+		} else if fields := deviceChanges(dev, updated); len(fields) > 0 {
+			line := fmt.Sprintf("~ %s: %s", dev.Serial, strings.Join(fields, ", "))
+			// The tunnel listens on the old port, so it can't be kept.
+			if dev.offset != updated.offset && dev.inUse() {
+				dev.disconnect()
+				line += " (disconnected)"
+			}
+			dev.update(updated)
+			changed++
+			diff = append(diff, line)
+		}
+
+		deviceList = append(deviceList, dev)
+		devicesBySerial[dev.Serial] = dev
+	}
+
+	for _, dev := range dset.deviceList {
+		if _, kept := devicesBySerial[dev.Serial]; kept {
+			continue
+		}
+		if dev.ID == "" {
+			deviceList = append(deviceList, dev)
+			devicesBySerial[dev.Serial] = dev
+			continue
+		}
+
+		line := "- " + dev.Serial
+		if dev.inUse() {
+			dev.disconnect()
+			line += " (disconnected)"
+		}
+		removed++
+		diff = append(diff, line)
+	}
+
+	dset.deviceList = deviceList
+	dset.devicesBySerial = devicesBySerial
+
+	// fetchCached has already said why the inventory is stale, periodic
+	// reloads only add the notice when it becomes stale.
+	wasStale := !dset.staleSince.IsZero()
+	dset.staleSince = staleSince
+	reported := !staleSince.IsZero()
+	if notice := dset.staleNotice(); notice != "" && (!quiet || !wasStale) {
+		fmt.Println(notice)
+	}
+
+	if quiet && len(diff) == 0 {
+		return reported, nil
+	}
+	fmt.Printf("\nReloaded %s: %d added, %d removed, %d changed\n", config.DevicesPath, added, removed, changed)
+	for _, line := range diff {
+		fmt.Println(line)
+	}
+	return true, nil
+}
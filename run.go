@@ -0,0 +1,201 @@
+// Non-interactive command execution on devices.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type runOptions struct {
+	parallel   int
+	timeout    time.Duration
+	reportPath string
+}
+
+type runResult struct {
+	Serial   string  `json:"serial"`
+	ID       int     `json:"id"`
+	ExitCode int     `json:"exit_code"`
+	Stdout   string  `json:"stdout"`
+	Stderr   string  `json:"stderr"`
+	Error    string  `json:"error,omitempty"`
+	TimedOut bool    `json:"timed_out,omitempty"`
+	Seconds  float64 `json:"seconds"`
+}
+
+type runReport struct {
+	Target  string      `json:"target"`
+	Command string      `json:"command"`
+	Started time.Time   `json:"started"`
+	Results []runResult `json:"results"`
+}
+
+// parseRunArgs parses "[options] <device or @group> [--] <command...>".
+func parseRunArgs(args []string) (*runOptions, string, string, error) {
+	opts := &runOptions{}
+
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	flags.SetOutput(os.Stdout)
+	flags.IntVar(&opts.parallel, "parallel", config.RunParallel, "maximum number of devices to run on at once")
+	flags.DurationVar(&opts.timeout, "timeout", time.Duration(config.RunTimeout)*time.Second, "time limit per device")
+	flags.StringVar(&opts.reportPath, "report", "", "JSON report file (default is a timestamped file in the cache directory)")
+	flags.Usage = func() {
+		fmt.Println("usage: run [options] <device or @group> [--] <command>")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return nil, "", "", err
+	}
+
+	rest := flags.Args()
+	if len(rest) >= 2 && rest[1] == "--" {
+		rest = append(rest[:1], rest[2:]...)
+	}
+	if len(rest) < 2 {
+		flags.Usage()
+		return nil, "", "", errors.New("run: device and command required")
+	}
+
+	if opts.parallel < 1 {
+		opts.parallel = 1
+	}
+
+	return opts, rest[0], strings.Join(rest[1:], " "), nil
+}
+
+// run executes a shell command on the device over its already open tunnel.
+func (dev *Device) run(ctx context.Context, command string) runResult {
+	result := runResult{Serial: dev.Serial, ID: dev.offset}
+
+	runArgs := strings.Fields(fmt.Sprintf("ssh %s -o BatchMode=yes %s -p %d %s@localhost",
+		dev.sshOptions(), dev.hostKeyOptions(), dev.port, dev.User))
+	runArgs = append(runArgs, command)
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, runArgs[0], runArgs[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	started := time.Now()
+	err := cmd.Run()
+	result.Seconds = time.Since(started).Seconds()
+	result.Stdout = stdout.String()
+	result.Stderr = stderr.String()
+	result.ExitCode = cmd.ProcessState.ExitCode()
+
+	if ctx.Err() == context.DeadlineExceeded {
+		result.TimedOut = true
+		result.Error = "timed out"
+	} else if err != nil {
+		result.Error = err.Error()
+	}
+
+	return result
+}
+
+// runCommand runs a command on each selected device, in parallel up to
+// opts.parallel at a time, prints the combined results in device order,
+// and saves them as a JSON report. Tunnels are opened beforehand from the
+// calling goroutine, only the ssh commands run concurrently.
+func (dset *DeviceSet) runCommand(opts *runOptions, spec string, command string) (*runReport, error) {
+	devices, err := dset.selectDevices(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &runReport{Target: spec, Command: command, Started: time.Now(),
+		Results: make([]runResult, len(devices))}
+
+	var wg sync.WaitGroup
+	slots := make(chan bool, opts.parallel)
+
+	for i, dev := range devices {
+		if err := dev.tunnelSetup(); err != nil {
+			report.Results[i] = runResult{Serial: dev.Serial, ID: dev.offset, ExitCode: -1, Error: err.Error()}
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, dev *Device) {
+			defer wg.Done()
+			slots <- true
+			defer func() { <-slots }()
+
+			ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+			defer cancel()
+			report.Results[i] = dev.run(ctx, command)
+		}(i, dev)
+	}
+
+	wg.Wait()
+
+	failed := 0
+	for _, result := range report.Results {
+		status := fmt.Sprintf("exit %d", result.ExitCode)
+		if result.Error != "" {
+			status = result.Error
+			failed++
+		}
+		fmt.Printf("=== %s (%s, %.1fs)\n%s", result.Serial, status, result.Seconds, result.Stdout)
+		if result.Stderr != "" {
+			fmt.Printf("--- stderr\n%s", result.Stderr)
+		}
+	}
+
+	reportPath := opts.reportPath
+	if reportPath == "" {
+		reportPath = filepath.Join(cacheDir(), "runs", report.Started.Format("20060102-150405")+".json")
+	}
+	if err := report.save(reportPath); err != nil {
+		fmt.Println("error saving report:", err)
+	} else {
+		fmt.Printf("\n%d of %d succeeded, report saved to %s\n", len(devices)-failed, len(devices), reportPath)
+	}
+
+	if failed > 0 {
+		return report, fmt.Errorf("run failed on %d of %d devices", failed, len(devices))
+	}
+	return report, nil
+}
+
+func (report *runReport) save(path string) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// runMain implements "rdevcon run ...", returning the process exit code.
+func runMain(dset *DeviceSet, args []string) int {
+	defer tunnels.closeAll()
+
+	opts, spec, command, err := parseRunArgs(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if _, err := dset.runCommand(opts, spec, command); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
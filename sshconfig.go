@@ -0,0 +1,127 @@
+// OpenSSH client configuration for the fleet, so that plain ssh, scp,
+// rsync and editors with remote ssh support can reach devices directly.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Alias of the hub entry in generated configs.
+const sshConfigHub = "rdevcon-hub"
+
+// sshConfig writes a Host entry for the hub and for each visible device.
+// By default devices are reached with ProxyJump through the hub. With
+// localForward, the hub entry instead forwards every device port, and
+// devices are reached at localhost while "ssh -N rdevcon-hub" runs. The
+// hub entry requires the hub's key to be in ~/.ssh/known_hosts already, so
+// plain ssh never trusts it on first use.
+func (dset *DeviceSet) sshConfig(w io.Writer, localForward bool) error {
+	user, addr, err := hubAddr()
+	if err != nil {
+		return err
+	}
+	if !hubKnown(addr) {
+		advice := "set HubFingerprints or HubFingerprintsPath, or add its key to ~/.ssh/known_hosts once it's checked"
+		if hubPinned() {
+			advice = "open a tunnel first, which records its verified key"
+		}
+		return fmt.Errorf("hub %s isn't in ~/.ssh/known_hosts, so plain ssh couldn't verify it, %s", addr, advice)
+	}
+	host, port, _ := net.SplitHostPort(addr)
+
+	devices := dset.visible()
+
+	fmt.Fprintln(w, "# Generated by rdevcon, changes will be overwritten.")
+	fmt.Fprintf(w, "\nHost %s\n", sshConfigHub)
+	fmt.Fprintf(w, "    HostName %s\n", host)
+	fmt.Fprintf(w, "    Port %s\n", port)
+	fmt.Fprintf(w, "    User %s\n", user)
+	if path, ok := localPath(config.TunnelKeyPath); ok && path != "" {
+		keyPath, _ := filepath.Abs(path)
+		fmt.Fprintf(w, "    IdentityFile %s\n", keyPath)
+	}
+	fmt.Fprintf(w, "    StrictHostKeyChecking yes\n")
+	if localForward {
+		fmt.Fprintf(w, "    ExitOnForwardFailure no\n")
+		for _, dev := range devices {
+			fmt.Fprintf(w, "    LocalForward %d localhost:%d\n", dev.port, dev.port)
+		}
+	}
+
+	for _, dev := range devices {
+		fmt.Fprintf(w, "\n# %s\n", strings.TrimSpace(dev.Location+" "+dev.Comment))
+		fmt.Fprintf(w, "Host %s %d\n", dev.Serial, dev.offset)
+		fmt.Fprintf(w, "    HostName localhost\n")
+		fmt.Fprintf(w, "    Port %d\n", dev.port)
+		fmt.Fprintf(w, "    User %s\n", dev.User)
+		if !localForward {
+			fmt.Fprintf(w, "    ProxyJump %s\n", sshConfigHub)
+		}
+		fmt.Fprintf(w, "    HostKeyAlias %s\n", dev.Serial)
+		fmt.Fprintf(w, "    UserKnownHostsFile %s\n", knownHostsPath())
+		fmt.Fprintf(w, "    StrictHostKeyChecking accept-new\n")
+		fmt.Fprintf(w, "    UpdateHostKeys no\n")
+		fmt.Fprintf(w, "    HashKnownHosts no\n")
+	}
+
+	return nil
+}
+
+// sshConfigPath returns the default file for the generated config, which
+// is meant to be included from ~/.ssh/config.
+func sshConfigPath() string {
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".ssh", "rdevcon_config")
+}
+
+// writeSshConfig saves the generated config to path, and explains how to
+// include it. The config is generated first and then renamed into place,
+// so a failure leaves any previous file as it was.
+func (dset *DeviceSet) writeSshConfig(path string, localForward bool) error {
+	// With pinned fingerprints, connecting records the verified hub key.
+	if _, addr, err := hubAddr(); err == nil && hubPinned() && !hubKnown(addr) {
+		if _, err := tunnels.connect(); err != nil {
+			return err
+		}
+	}
+
+	var generated bytes.Buffer
+	if err := dset.sshConfig(&generated, localForward); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(generated.Bytes())
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return err
+	}
+
+	fmt.Printf("Wrote ssh config for %d devices to %s\n", len(dset.visible()), path)
+	fmt.Printf("To use it, add this line near the top of ~/.ssh/config, before any Host entries:\n")
+	fmt.Printf("Include %s\n", path)
+	if localForward {
+		fmt.Printf("Then keep \"ssh -N %s\" running while connecting to devices.\n", sshConfigHub)
+	}
+	return nil
+}
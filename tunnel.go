@@ -0,0 +1,620 @@
+// In-process ssh tunnels to the hub.
+//
+// A single ssh client connection to TunnelNameAddr carries the local
+// forward for every device, so opening another device only costs a new
+// listener and a channel per forwarded connection, not another handshake.
+//
+// If the hub connection drops, or the hub can no longer reach a device,
+// a supervisor goroutine reconnects with exponential backoff. Forwards
+// that can't be restored are closed and reported on the DeviceSet's
+// tunnelFinish channel.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	tunnelUp           = "up"
+	tunnelReconnecting = "reconnecting"
+	tunnelFailed       = "failed"
+
+	tunnelKeepalive     = 15 * time.Second
+	tunnelFirstBackoff  = 1 * time.Second
+	tunnelMaxBackoff    = 60 * time.Second
+	tunnelRetryAttempts = 10
+)
+
+type tunnelForward struct {
+	dev        *Device
+	listener   net.Listener
+	remoteAddr string
+	state      string
+	reason     string
+}
+
+// The tunnel manager is used from the main loop and from forwarding and
+// supervisor goroutines, so its state is guarded by a mutex. Dialing the
+// hub can take a while, so it's done under dialMutex instead, which also
+// guards the signer, and only one goroutine dials at a time.
+type tunnelManager struct {
+	mutex       sync.Mutex
+	dialMutex   sync.Mutex
+	client      *ssh.Client
+	signer      ssh.Signer
+	forwards    map[*Device]*tunnelForward
+	failures    map[*Device]string
+	supervising bool
+	closing     bool
+}
+
+var tunnels = &tunnelManager{forwards: make(map[*Device]*tunnelForward),
+	failures: make(map[*Device]string)}
+
+// hubAddr splits TunnelNameAddr (user@host or user@host:port) into the
+// user and a dialable address.
+func hubAddr() (string, string, error) {
+	user, host, found := strings.Cut(config.TunnelNameAddr, "@")
+	if !found || user == "" || host == "" {
+		return "", "", fmt.Errorf("invalid TunnelNameAddr %q, expected user@host", config.TunnelNameAddr)
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "22")
+	}
+	return user, host, nil
+}
+
+// loadSigner loads the tunnel key. The key is fetched into memory and
+// never written to disk, whether it's on S3 or a web server, and the raw
+// key data is cleared once parsed, so only the signer holds the key for
+// the lifetime of the process.
+func (tm *tunnelManager) loadSigner() (ssh.Signer, error) {
+	if tm.signer != nil {
+		return tm.signer, nil
+	}
+
+	keyData, err := fetch(config.TunnelKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("tunnel key %s: %w", config.TunnelKeyPath, err)
+	}
+
+	tm.signer, err = ssh.ParsePrivateKey(keyData)
+	clear(keyData)
+	if err != nil {
+		return nil, fmt.Errorf("tunnel key %s: %w", config.TunnelKeyPath, err)
+	}
+
+	return tm.signer, nil
+}
+
+// hubFingerprints returns the expected SHA256 fingerprints of the hub's
+// host keys, from HubFingerprints and the file at HubFingerprintsPath.
+// Entries can be fingerprints as printed by "ssh-keygen -l", or public
+// keys in authorized_keys or known_hosts format.
+func hubFingerprints() ([]string, error) {
+	entries := config.HubFingerprints
+	if config.HubFingerprintsPath != "" {
+		data, _, err := fetchCached(config.HubFingerprintsPath)
+		if err != nil {
+			return nil, fmt.Errorf("tunnel: hub fingerprints: %w", err)
+		}
+		entries = append(slices.Clone(entries), strings.Split(string(data), "\n")...)
+	}
+
+	var fingerprints []string
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		if strings.HasPrefix(entry, "SHA256:") {
+			fingerprints = append(fingerprints, strings.Fields(entry)[0])
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(entry))
+		if err != nil {
+			_, _, key, _, _, err = ssh.ParseKnownHosts([]byte(entry))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("tunnel: hub fingerprints: can't parse %q", entry)
+		}
+		fingerprints = append(fingerprints, ssh.FingerprintSHA256(key))
+	}
+	return fingerprints, nil
+}
+
+// hubHostKeyCallback checks the hub host key against the configured
+// fingerprints. If there are none, the hub must already be in known_hosts,
+// it isn't trusted on first use.
+func hubHostKeyCallback(fingerprints []string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if len(fingerprints) == 0 {
+			fmt.Println("*** hub host key not pinned, set HubFingerprints or HubFingerprintsPath")
+			return knownHostsVerify(hostname, remote, key, false)
+		}
+
+		fingerprint := ssh.FingerprintSHA256(key)
+		if !slices.Contains(fingerprints, fingerprint) {
+			return fmt.Errorf("*** hub %s host key %s doesn't match any configured hub fingerprint, refusing to connect",
+				hostname, fingerprint)
+		}
+
+		// Record the verified key for plain ssh, see sshconfig.go.
+		if err := knownHostsVerify(hostname, remote, key, true); err != nil {
+			fmt.Println(err)
+		}
+		return nil
+	}
+}
+
+// hubPinned reports whether hub fingerprints are configured.
+func hubPinned() bool {
+	return len(config.HubFingerprints) > 0 || config.HubFingerprintsPath != ""
+}
+
+// hubKnownHostsPath returns ssh's own known_hosts file, where the hub key
+// is kept.
+func hubKnownHostsPath() string {
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".ssh", "known_hosts")
+}
+
+// hubKnown reports whether ssh's known_hosts has a key for the hub at addr.
+func hubKnown(addr string) bool {
+	check, err := knownhosts.New(hubKnownHostsPath())
+	if err != nil {
+		return false
+	}
+	remote, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		remote = &net.TCPAddr{IP: net.IPv4zero}
+	}
+
+	// Any key but the hub's is refused, listing the hub's keys if it's known.
+	public, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return false
+	}
+	probe, err := ssh.NewPublicKey(public)
+	if err != nil {
+		return false
+	}
+	var keyErr *knownhosts.KeyError
+	return errors.As(check(addr, remote, probe), &keyErr) && len(keyErr.Want) > 0
+}
+
+// knownHostsVerify checks the hub host key against ~/.ssh/known_hosts. If
+// the hub is unknown, its key is added with acceptNew, like ssh's
+// StrictHostKeyChecking=accept-new, and refused otherwise.
+func knownHostsVerify(hostname string, remote net.Addr, key ssh.PublicKey, acceptNew bool) error {
+	knownHostsPath := hubKnownHostsPath()
+
+	check, err := knownhosts.New(knownHostsPath)
+	if err == nil {
+		err = check(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+		if len(keyErr.Want) > 0 {
+			return fmt.Errorf("*** host key for hub %s has changed, check %s: %w", hostname, knownHostsPath, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if !acceptNew {
+		return fmt.Errorf("*** hub %s host key %s is unknown, refusing to connect. Set HubFingerprints or HubFingerprintsPath, or add the hub to %s once its key is checked",
+			hostname, ssh.FingerprintSHA256(key), knownHostsPath)
+	}
+
+	os.MkdirAll(filepath.Dir(knownHostsPath), 0700)
+	file, err := os.OpenFile(knownHostsPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+	if _, err = fmt.Fprintln(file, line); err != nil {
+		return err
+	}
+	fmt.Printf("Permanently added %s to %s\n", hostname, knownHostsPath)
+
+	return nil
+}
+
+// connect returns the client connection to the hub, dialing it if needed.
+// The hub fingerprints are fetched and the hub dialed without holding the
+// mutex, so that tunnel state can still be read meanwhile.
+func (tm *tunnelManager) connect() (*ssh.Client, error) {
+	tm.dialMutex.Lock()
+	defer tm.dialMutex.Unlock()
+
+	if client := tm.currentClient(); client != nil {
+		return client, nil
+	}
+
+	user, addr, err := hubAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	auth := []ssh.AuthMethod{}
+	if config.TunnelKeyPath != "" {
+		signer, err := tm.loadSigner()
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		// The agent is only needed for the handshake.
+		if conn, err := net.Dial("unix", sock); err == nil {
+			defer conn.Close()
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+
+	fingerprints, err := hubFingerprints()
+	if err != nil {
+		return nil, err
+	}
+
+	clientConfig := &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hubHostKeyCallback(fingerprints),
+		Timeout:         15 * time.Second,
+	}
+
+	fmt.Printf("tunnel: connecting to %s\n", config.TunnelNameAddr)
+	client, err := ssh.Dial("tcp", addr, clientConfig)
+	if err != nil {
+		return nil, fmt.Errorf("tunnel: %w", err)
+	}
+
+	tm.mutex.Lock()
+	if tm.closing {
+		tm.mutex.Unlock()
+		client.Close()
+		return nil, errors.New("tunnel: closing")
+	} else if tm.client != nil {
+		// Connected meanwhile, keep that one.
+		existing := tm.client
+		tm.mutex.Unlock()
+		client.Close()
+		return existing, nil
+	}
+	tm.client = client
+	tm.mutex.Unlock()
+
+	go tm.keepalive(client)
+
+	go func() {
+		err := client.Wait()
+		tm.mutex.Lock()
+		lost := tm.client == client && !tm.closing
+		if tm.client == client {
+			tm.client = nil
+		}
+		tm.mutex.Unlock()
+
+		if lost {
+			fmt.Printf("tunnel: hub connection lost (%v)\n", err)
+			tm.setAll(tunnelReconnecting, "hub connection lost")
+			go tm.supervise()
+		}
+	}()
+
+	return client, nil
+}
+
+// keepalive closes the client if the hub stops answering keepalive
+// requests, so that a dead network path is noticed and reconnected.
+func (tm *tunnelManager) keepalive(client *ssh.Client) {
+	for {
+		time.Sleep(tunnelKeepalive)
+		if tm.currentClient() != client {
+			return
+		}
+
+		replied := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			replied <- err
+		}()
+
+		select {
+		case err := <-replied:
+			if err != nil {
+				client.Close()
+				return
+			}
+		case <-time.After(tunnelKeepalive):
+			fmt.Println("tunnel: hub not responding to keepalives")
+			client.Close()
+			return
+		}
+	}
+}
+
+// currentClient returns the hub connection without dialing.
+func (tm *tunnelManager) currentClient() *ssh.Client {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	return tm.client
+}
+
+// open forwards localhost:port to the device's reverse port on the hub.
+// It returns once the hub has accepted a test connection to the device
+// port, so the tunnel is known to be ready.
+func (tm *tunnelManager) open(dev *Device) error {
+	tm.mutex.Lock()
+	existing, ok := tm.forwards[dev]
+	up := ok && existing.state == tunnelUp
+	tm.mutex.Unlock()
+	if ok {
+		if up {
+			return nil
+		}
+		return fmt.Errorf("tunnel for %s is %s", dev.Serial, tm.state(dev))
+	}
+
+	client, err := tm.connect()
+	if err != nil {
+		return err
+	}
+
+	remoteAddr := net.JoinHostPort("localhost", strconv.Itoa(dev.port))
+	if err = probeRemote(client, remoteAddr); err != nil {
+		return fmt.Errorf("tunnel: %s is not connected to the hub: %w", dev.Serial, err)
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(dev.port)))
+	if err != nil {
+		return fmt.Errorf("tunnel: %w", err)
+	}
+
+	forward := &tunnelForward{dev: dev, listener: listener, remoteAddr: remoteAddr, state: tunnelUp}
+
+	tm.mutex.Lock()
+	tm.forwards[dev] = forward
+	delete(tm.failures, dev)
+	tm.mutex.Unlock()
+
+	fmt.Printf("tunnel: %s -> hub %s for %s\n", listener.Addr(), remoteAddr, dev.Serial)
+
+	go tm.serve(forward)
+
+	return nil
+}
+
+// probeRemote checks that the hub accepts a connection to addr.
+func probeRemote(client *ssh.Client, addr string) error {
+	conn, err := client.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// serve accepts local connections and forwards each over the current hub
+// connection, until the listener is closed.
+func (tm *tunnelManager) serve(forward *tunnelForward) {
+	for {
+		local, err := forward.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer local.Close()
+
+			client := tm.currentClient()
+			if client == nil {
+				fmt.Printf("tunnel: no hub connection for %s\n", forward.dev.Serial)
+				return
+			}
+
+			remote, err := client.Dial("tcp", forward.remoteAddr)
+			if err != nil {
+				// Most likely the device has dropped its connection to the hub.
+				fmt.Printf("tunnel: %s: %v\n", forward.dev.Serial, err)
+				tm.setState(forward, tunnelReconnecting, err.Error())
+				go tm.supervise()
+				return
+			}
+			defer remote.Close()
+
+			copied := make(chan bool, 2)
+			go func() {
+				io.Copy(remote, local)
+				copied <- true
+			}()
+			go func() {
+				io.Copy(local, remote)
+				copied <- true
+			}()
+			<-copied
+		}()
+	}
+}
+
+// state describes the device's tunnel: up, reconnecting or failed, with
+// the reason if there is one, or "" if there is no tunnel.
+func (tm *tunnelManager) state(dev *Device) string {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	if forward, ok := tm.forwards[dev]; ok {
+		if forward.state != tunnelUp && forward.reason != "" {
+			return fmt.Sprintf("%s (%s)", forward.state, forward.reason)
+		}
+		return forward.state
+	}
+	if reason, ok := tm.failures[dev]; ok {
+		return fmt.Sprintf("%s (%s)", tunnelFailed, reason)
+	}
+	return ""
+}
+
+func (tm *tunnelManager) setState(forward *tunnelForward, state string, reason string) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	forward.state = state
+	forward.reason = reason
+}
+
+func (tm *tunnelManager) setAll(state string, reason string) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	for _, forward := range tm.forwards {
+		forward.state = state
+		forward.reason = reason
+	}
+}
+
+// pending returns the forwards that aren't up.
+func (tm *tunnelManager) pending() []*tunnelForward {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	var forwards []*tunnelForward
+	for _, forward := range tm.forwards {
+		if forward.state != tunnelUp {
+			forwards = append(forwards, forward)
+		}
+	}
+	return forwards
+}
+
+// supervise restores pending forwards, reconnecting to the hub if
+// needed, with exponential backoff between attempts. Forwards still not
+// restored after tunnelRetryAttempts are closed, and reported to the main
+// loop on tunnelFinish. Only one supervisor runs at a time.
+func (tm *tunnelManager) supervise() {
+	tm.mutex.Lock()
+	if tm.supervising || tm.closing {
+		tm.mutex.Unlock()
+		return
+	}
+	tm.supervising = true
+	tm.mutex.Unlock()
+
+	defer func() {
+		tm.mutex.Lock()
+		tm.supervising = false
+		tm.mutex.Unlock()
+	}()
+
+	backoff := tunnelFirstBackoff
+	for attempt := 1; ; attempt++ {
+		pending := tm.pending()
+		if len(pending) == 0 {
+			return
+		}
+
+		if attempt > tunnelRetryAttempts {
+			for _, forward := range pending {
+				tm.fail(forward)
+			}
+			return
+		}
+
+		time.Sleep(backoff)
+		backoff = min(backoff*2, tunnelMaxBackoff)
+
+		tm.mutex.Lock()
+		closing := tm.closing
+		tm.mutex.Unlock()
+		if closing {
+			return
+		}
+
+		retrying := fmt.Sprintf("attempt %d of %d", attempt, tunnelRetryAttempts)
+
+		client, err := tm.connect()
+		if err != nil {
+			fmt.Println(err)
+			for _, forward := range pending {
+				tm.setState(forward, tunnelReconnecting, fmt.Sprintf("%s: %v", retrying, err))
+			}
+			continue
+		}
+
+		for _, forward := range pending {
+			if err := probeRemote(client, forward.remoteAddr); err != nil {
+				tm.setState(forward, tunnelReconnecting, fmt.Sprintf("%s: %v", retrying, err))
+				continue
+			}
+			tm.setState(forward, tunnelUp, "")
+			fmt.Printf("tunnel: restored for %s\n", forward.dev.Serial)
+		}
+	}
+}
+
+// fail closes a forward that couldn't be restored, and reports it to the
+// main loop.
+func (tm *tunnelManager) fail(forward *tunnelForward) {
+	tm.mutex.Lock()
+	if tm.forwards[forward.dev] != forward {
+		// Closed in the meantime.
+		tm.mutex.Unlock()
+		return
+	}
+	delete(tm.forwards, forward.dev)
+	tm.failures[forward.dev] = fmt.Sprintf("gave up reconnecting, %s", forward.reason)
+	tm.mutex.Unlock()
+
+	forward.listener.Close()
+	forward.dev.parent.tunnelFinish <- forward.dev
+}
+
+// close removes the device's forward. Connections already forwarded are
+// left to finish on their own.
+func (tm *tunnelManager) close(dev *Device) {
+	tm.mutex.Lock()
+	forward, ok := tm.forwards[dev]
+	delete(tm.forwards, dev)
+	tm.mutex.Unlock()
+
+	if ok {
+		forward.listener.Close()
+	}
+}
+
+// closeAll removes all forwards and closes the hub connection.
+func (tm *tunnelManager) closeAll() {
+	tm.mutex.Lock()
+	tm.closing = true
+	forwards := tm.forwards
+	tm.forwards = make(map[*Device]*tunnelForward)
+	client := tm.client
+	tm.client = nil
+	tm.mutex.Unlock()
+
+	for _, forward := range forwards {
+		forward.listener.Close()
+	}
+	if client != nil {
+		client.Close()
+	}
+}
@@ -3,56 +3,266 @@
 package main
 
 import (
+	"cmp"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
-	//"time"
 )
 
-func checkForUpdates() {
-	if config.SelfUpdatePath == "" {
-		return
+// A release is described by a manifest stored next to the binary at
+// updatePath(channel)+".manifest", signed with the release key. The
+// signature, base64 encoded, is at updatePath(channel)+".manifest.sig".
+// See release.go for producing them.
+type updateManifest struct {
+	Version string `json:"version"`
+	Channel string `json:"channel"`
+	Notes   string `json:"notes,omitempty"`
+	SHA256  string `json:"sha256"`
+	Size    int    `json:"size"`
+}
+
+type updateOptions struct {
+	channel        string
+	allowDowngrade bool
+	// At startup, a version that was rolled back from isn't reinstalled.
+	startup bool
+}
+
+// updatePublicKey returns the compiled-in key that release manifests must
+// be signed with.
+func updatePublicKey() (ed25519.PublicKey, error) {
+	if config.UpdatePublicKey == "" {
+		return nil, errors.New("no UpdatePublicKey configured, can't verify updates")
 	}
+	key, err := base64.StdEncoding.DecodeString(config.UpdatePublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid UpdatePublicKey")
+	}
+	return ed25519.PublicKey(key), nil
+}
 
-	defer fmt.Println("")
+// verifyManifest checks the manifest signature and parses it.
+func verifyManifest(data []byte, signature []byte) (*updateManifest, error) {
+	key, err := updatePublicKey()
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil || !ed25519.Verify(key, data, sig) {
+		return nil, errors.New("manifest signature verification failed")
+	}
+
+	manifest := &updateManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+// updatePath returns where a channel's releases are published. Stable
+// releases are at SelfUpdatePath, other channels at SelfUpdatePath-<channel>.
+func updatePath(channel string) string {
+	if channel == "stable" {
+		return config.SelfUpdatePath
+	}
+	return config.SelfUpdatePath + "-" + channel
+}
+
+// fetchManifest downloads and verifies the manifest for a channel. If it
+// can't be downloaded, a cached copy is used, which is still verified.
+func fetchManifest(channel string) (*updateManifest, error) {
+	path := updatePath(channel)
+	data, _, err := fetchCached(path + ".manifest")
+	if err != nil {
+		return nil, err
+	}
+	signature, _, err := fetchCached(path + ".manifest.sig")
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := verifyManifest(data, signature)
+	if err != nil {
+		return nil, err
+	}
+
+	// The channel is signed too, so a release can't be moved to another
+	// channel's path.
+	if manifest.Channel != channel {
+		return nil, fmt.Errorf("manifest at %s is for channel %q, not %q", path, manifest.Channel, channel)
+	}
+	return manifest, nil
+}
+
+// verify checks that a downloaded binary is the one the manifest describes.
+func (manifest *updateManifest) verify(binary []byte) error {
+	sum := sha256.Sum256(binary)
+	if len(binary) != manifest.Size || hex.EncodeToString(sum[:]) != manifest.SHA256 {
+		return errors.New("downloaded binary doesn't match the signed manifest")
+	}
+	return nil
+}
+
+type semver struct {
+	numbers    [3]int
+	prerelease []string
+}
+
+func parseVersion(s string) (semver, bool) {
+	var v semver
+	s, _, _ = strings.Cut(strings.TrimPrefix(s, "v"), "+")
+	core, prerelease, hasPrerelease := strings.Cut(s, "-")
+
+	parts := strings.Split(core, ".")
+	if len(parts) != 3 {
+		return v, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, false
+		}
+		v.numbers[i] = n
+	}
+	if hasPrerelease {
+		v.prerelease = strings.Split(prerelease, ".")
+	}
+	return v, true
+}
+
+// compareVersions compares semantic versions like 1.2.3 or v1.3.0-beta.2,
+// returning -1, 0 or 1. Versions that don't parse, like "dev", sort before
+// all others.
+func compareVersions(a string, b string) int {
+	va, okA := parseVersion(a)
+	vb, okB := parseVersion(b)
+	if !okA || !okB {
+		if okA == okB {
+			return 0
+		} else if okA {
+			return 1
+		}
+		return -1
+	}
+
+	for i := range va.numbers {
+		if c := cmp.Compare(va.numbers[i], vb.numbers[i]); c != 0 {
+			return c
+		}
+	}
+
+	// A prerelease sorts before its release.
+	if len(va.prerelease) == 0 || len(vb.prerelease) == 0 {
+		return cmp.Compare(len(vb.prerelease), len(va.prerelease))
+	}
+	for i := 0; i < len(va.prerelease) && i < len(vb.prerelease); i++ {
+		na, errA := strconv.Atoi(va.prerelease[i])
+		nb, errB := strconv.Atoi(vb.prerelease[i])
+		c := 0
+		if errA == nil && errB == nil {
+			c = cmp.Compare(na, nb)
+		} else if errA == nil {
+			c = -1
+		} else if errB == nil {
+			c = 1
+		} else {
+			c = strings.Compare(va.prerelease[i], vb.prerelease[i])
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(va.prerelease), len(vb.prerelease))
+}
+
+// rollbackHoldPath is where the version rolled back from is kept, so that
+// the startup check doesn't immediately reinstall it.
+func rollbackHoldPath() string {
+	return filepath.Join(cacheDir(), "rollback-hold")
+}
+
+func parseUpdateArgs(args []string) (updateOptions, error) {
+	opts := updateOptions{}
+	flags := flag.NewFlagSet("update", flag.ContinueOnError)
+	flags.StringVar(&opts.channel, "channel", config.UpdateChannel, "release channel, like stable or beta")
+	flags.BoolVar(&opts.allowDowngrade, "allow-downgrade", false, "install the channel's release even if it isn't newer")
+	positional, err := parseArgs(flags, args)
+	if err == nil && len(positional) > 0 {
+		flags.Usage()
+		err = errors.New("update: unexpected arguments")
+	}
+	return opts, err
+}
+
+// selfUpdate installs the latest release on a channel, if it's newer than
+// this build. It returns true if a new binary was installed.
+func selfUpdate(opts updateOptions) (bool, error) {
+	if config.SelfUpdatePath == "" {
+		return false, errors.New("no SelfUpdatePath configured")
+	}
 
 	executable, _ := os.Executable()
+	path := updatePath(opts.channel)
 
-	fmt.Printf("Checking for new version at %s\n", config.SelfUpdatePath)
-	key := "X-Sha1"
-	aws_sha1, err := s3Metadata(config.SelfUpdatePath, key)
+	fmt.Printf("Checking for new %s version at %s\n", opts.channel, path)
+	manifest, err := fetchManifest(opts.channel)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return false, err
 	}
 
-	if aws_sha1 == "" {
-		fmt.Printf("key %s is empty or not set on %s\n", key, config.SelfUpdatePath)
-		return
+	if sha256string(executable) == manifest.SHA256 {
+		fmt.Printf("Have latest %s version %s.\n", opts.channel, manifest.Version)
+		return false, nil
 	}
 
-	exe_sha1 := sha1string(executable)
+	if opts.startup {
+		if held, err := os.ReadFile(rollbackHoldPath()); err == nil && strings.TrimSpace(string(held)) == manifest.Version {
+			fmt.Printf("Not reinstalling version %s after rollback, use update to install it.\n", manifest.Version)
+			return false, nil
+		}
+	}
 
-	if exe_sha1 == aws_sha1 {
-		fmt.Println("Have latest version.")
-		return
+	if !opts.allowDowngrade {
+		if c := compareVersions(manifest.Version, version); c < 0 {
+			fmt.Printf("Version %s is newer than %s release %s, not downgrading.\n", version, opts.channel, manifest.Version)
+			return false, nil
+		} else if c == 0 {
+			fmt.Printf("Have %s version %s.\n", opts.channel, version)
+			return false, nil
+		}
 	}
 
-	fmt.Println("Checksum mismatch! Getting new version...")
+	fmt.Printf("Updating from version %s to %s...\n", version, manifest.Version)
+	if manifest.Notes != "" {
+		fmt.Printf("Release notes:\n%s\n", strings.TrimRight(manifest.Notes, "\n"))
+	}
 
 	for _, f := range []string{"main.go", "rdevcon/main.go"} {
 		if _, err = os.Stat(f); err == nil {
-			fmt.Println("*** Not updating inside development tree.")
-			return
+			return false, errors.New("not updating inside development tree")
 		}
 	}
 
-	newBinary, err := s3Get(config.SelfUpdatePath)
+	newBinary, err := fetch(path)
 	if err != nil {
-		fmt.Println("error getting %s\n", config.SelfUpdatePath)
-		return
+		return false, fmt.Errorf("error getting %s: %w", path, err)
+	}
+
+	if err = manifest.verify(newBinary); err != nil {
+		return false, fmt.Errorf("not installing, %w", err)
 	}
 
 	// Rename current to old
@@ -62,18 +272,43 @@ func checkForUpdates() {
 
 	err = os.Rename(executable, backupName)
 	if err != nil {
-		fmt.Println("error renaming %s -> %s\n", executable, backupName)
-		return
+		return false, fmt.Errorf("error renaming %s -> %s", executable, backupName)
 	}
 
 	// Save new to current
 	err = os.WriteFile(executable, newBinary, 0700)
 	if err != nil {
-		fmt.Println("error writing new %s\n", executable)
+		return false, fmt.Errorf("error writing new %s", executable)
+	}
+
+	os.Remove(rollbackHoldPath())
+
+	return true, nil
+}
+
+// checkForUpdates runs at startup, and restarts into a newly installed
+// version.
+func checkForUpdates() {
+	if config.SelfUpdatePath == "" {
 		return
 	}
 
-	fmt.Println("Restarting...\n")
+	defer fmt.Println("")
+
+	// Once renamed, the running executable may resolve to the backup, so
+	// the path to restart is taken beforehand.
+	executable, _ := os.Executable()
+
+	installed, err := selfUpdate(updateOptions{channel: config.UpdateChannel, startup: true})
+	if err != nil {
+		fmt.Println("*** update:", err)
+		return
+	}
+	if !installed {
+		return
+	}
+
+	fmt.Print("Restarting...\n\n")
 
 	if runtime.GOOS == "windows" {
 		// Windows doesn't have exec(), so the best we can do is
@@ -94,5 +329,33 @@ func checkForUpdates() {
 			fmt.Println("Error re-executing program:", err)
 		}
 	}
+}
+
+// rollback swaps the running executable with the backup kept by the last
+// update, and holds back the version rolled back from.
+func rollback() error {
+	executable, _ := os.Executable()
+	backupName := executable + ".old"
+	swapName := executable + ".rollback"
+
+	if _, err := os.Stat(backupName); err != nil {
+		return fmt.Errorf("no previous version to roll back to: %w", err)
+	}
+
+	os.Remove(swapName)
+	if err := os.Rename(executable, swapName); err != nil {
+		return err
+	}
+	if err := os.Rename(backupName, executable); err != nil {
+		os.Rename(swapName, executable)
+		return err
+	}
+	if err := os.Rename(swapName, backupName); err != nil {
+		return err
+	}
+
+	os.WriteFile(rollbackHoldPath(), []byte(version+"\n"), 0600)
 
+	fmt.Printf("Rolled back from version %s, restart rdevcon to use the previous version.\n", version)
+	return nil
 }
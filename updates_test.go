@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// signedManifest returns a manifest and its signature made with key.
+func signedManifest(t *testing.T, key ed25519.PrivateKey, manifest updateManifest) ([]byte, []byte) {
+	t.Helper()
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(key, data))
+	return data, []byte(signature + "\n")
+}
+
+// useUpdateKey configures a fresh release key for the test.
+func useUpdateKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := config
+	config = &Config{UpdatePublicKey: base64.StdEncoding.EncodeToString(public)}
+	t.Cleanup(func() { config = saved })
+	return private
+}
+
+func TestVerifyManifest(t *testing.T) {
+	key := useUpdateKey(t)
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+
+	manifest := updateManifest{Version: "1.2.3", Channel: "stable", SHA256: strings.Repeat("ab", 32), Size: 10}
+	data, signature := signedManifest(t, key, manifest)
+	otherData, otherSignature := signedManifest(t, otherKey, manifest)
+	tampered := []byte(strings.Replace(string(data), "1.2.3", "9.9.9", 1))
+
+	tests := []struct {
+		name      string
+		data      []byte
+		signature []byte
+		ok        bool
+	}{
+		{"valid", data, signature, true},
+		{"tampered manifest", tampered, signature, false},
+		{"signed with another key", otherData, otherSignature, false},
+		{"signature of another manifest", data, otherSignature, false},
+		{"signature not base64", data, []byte("not base64!"), false},
+		{"empty signature", data, nil, false},
+	}
+	for _, test := range tests {
+		got, err := verifyManifest(test.data, test.signature)
+		if test.ok && (err != nil || got.Version != manifest.Version) {
+			t.Errorf("%s: got %+v, %v, want version %s", test.name, got, err, manifest.Version)
+		} else if !test.ok && err == nil {
+			t.Errorf("%s: verified, want an error", test.name)
+		}
+	}
+}
+
+func TestVerifyManifestWithoutKey(t *testing.T) {
+	key := useUpdateKey(t)
+	data, signature := signedManifest(t, key, updateManifest{Version: "1.2.3", Channel: "stable"})
+
+	for _, publicKey := range []string{"", "c2hvcnQ="} {
+		config.UpdatePublicKey = publicKey
+		if _, err := verifyManifest(data, signature); err == nil {
+			t.Errorf("UpdatePublicKey %q: verified, want an error", publicKey)
+		}
+	}
+}
+
+func TestFetchManifestChannel(t *testing.T) {
+	key := useUpdateKey(t)
+	dir := t.TempDir()
+	config.SelfUpdatePath = filepath.Join(dir, "rdevcon")
+
+	// A beta release copied to the stable path.
+	data, signature := signedManifest(t, key, updateManifest{Version: "2.0.0-beta.1", Channel: "beta"})
+	for _, channel := range []string{"stable", "beta"} {
+		path := updatePath(channel)
+		os.WriteFile(path+".manifest", data, 0600)
+		os.WriteFile(path+".manifest.sig", signature, 0600)
+	}
+
+	if _, err := fetchManifest("stable"); err == nil || !strings.Contains(err.Error(), "not \"stable\"") {
+		t.Errorf("stable: got %v, want a channel mismatch", err)
+	}
+	if manifest, err := fetchManifest("beta"); err != nil || manifest.Version != "2.0.0-beta.1" {
+		t.Errorf("beta: got %+v, %v", manifest, err)
+	}
+}
+
+func TestManifestVerifyBinary(t *testing.T) {
+	binary := []byte("rdevcon binary")
+	sum := sha256.Sum256(binary)
+	manifest := &updateManifest{SHA256: hex.EncodeToString(sum[:]), Size: len(binary)}
+
+	tests := []struct {
+		name   string
+		binary []byte
+		ok     bool
+	}{
+		{"matching", binary, true},
+		{"truncated", binary[:len(binary)-1], false},
+		{"same size, different content", []byte("rdevcon BINARY"), false},
+		{"empty", nil, false},
+	}
+	for _, test := range tests {
+		if err := manifest.verify(test.binary); (err == nil) != test.ok {
+			t.Errorf("%s: got %v, want ok %v", test.name, err, test.ok)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.3", "1.2.3", 0},
+		{"v1.2.3", "1.2.3", 0},
+		{"1.2.3+build.5", "1.2.3", 0},
+		{"1.2.4", "1.2.3", 1},
+		{"1.10.0", "1.9.9", 1},
+		{"2.0.0", "10.0.0", -1},
+		{"1.3.0-beta.1", "1.3.0", -1},
+		{"1.3.0-beta.1", "1.2.9", 1},
+		{"1.3.0-beta.2", "1.3.0-beta.10", -1},
+		{"1.3.0-alpha", "1.3.0-beta", -1},
+		{"1.3.0-beta", "1.3.0-beta.1", -1},
+		{"1.3.0-1", "1.3.0-alpha", -1},
+		{"1.3.0-rc.1", "1.3.0-beta.11", 1},
+		{"dev", "0.0.1", -1},
+		{"0.0.1", "dev", 1},
+		{"dev", "dev", 0},
+		{"dev", "1.2", 0},
+		{"1.2", "1.2.3", -1},
+		{"1.2.-3", "1.2.3", -1},
+	}
+	for _, test := range tests {
+		if got := compareVersions(test.a, test.b); got != test.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestSelfUpdateDowngrade(t *testing.T) {
+	key := useUpdateKey(t)
+	config.SelfUpdatePath = filepath.Join(t.TempDir(), "rdevcon")
+	data, signature := signedManifest(t, key, updateManifest{Version: "1.0.0", Channel: "stable"})
+	os.WriteFile(config.SelfUpdatePath+".manifest", data, 0600)
+	os.WriteFile(config.SelfUpdatePath+".manifest.sig", signature, 0600)
+
+	savedVersion := version
+	version = "1.1.0"
+	t.Cleanup(func() { version = savedVersion })
+
+	if installed, err := selfUpdate(updateOptions{channel: "stable"}); installed || err != nil {
+		t.Errorf("older release: got %v, %v, want nothing installed", installed, err)
+	}
+
+	// Past the version check, the update stops at the development tree the
+	// test runs in.
+	_, err := selfUpdate(updateOptions{channel: "stable", allowDowngrade: true})
+	if err == nil || !strings.Contains(err.Error(), "development tree") {
+		t.Errorf("allowed downgrade: got %v, want it to get past the version check", err)
+	}
+}
@@ -3,11 +3,12 @@
 package main
 
 import (
-	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
@@ -20,7 +21,7 @@ func atoi(sval string) int {
 	return int(ival)
 }
 
-func sha1string(path string) string {
+func sha256string(path string) string {
 	// Open the current executable file
 	file, err := os.Open(path)
 	if err != nil {
@@ -29,8 +30,8 @@ func sha1string(path string) string {
 	}
 	defer file.Close()
 
-	// Compute the SHA1 hash of the file
-	hash := sha1.New()
+	// Compute the SHA256 hash of the file
+	hash := sha256.New()
 	if _, err := io.Copy(hash, file); err != nil {
 		fmt.Println("Error:", err)
 		return ""
@@ -42,3 +43,15 @@ func sha1string(path string) string {
 	// Convert the byte slice to a hex string
 	return hex.EncodeToString(hashSum)
 }
+
+// cacheDir returns the per-user cache directory for rdevcon, creating it
+// if needed.
+func cacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	dir = filepath.Join(dir, "rdevcon")
+	os.MkdirAll(dir, 0700)
+	return dir
+}
@@ -0,0 +1,169 @@
+// VNC forwarding and viewer launch.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// How long the vnc command waits for a new forward to start listening.
+const vncForwardTimeout = 10 * time.Second
+
+// vncEnabled reports whether the device's VNC server is forwarded. The
+// device database can turn it on or off, otherwise the config file does,
+// and it's on by default.
+func (dev *Device) vncEnabled() bool {
+	if dev.Vnc != nil {
+		return *dev.Vnc
+	} else if config.Vnc != nil {
+		return *config.Vnc
+	}
+	return true
+}
+
+// vncForward returns the forward to the device's VNC server, which listens
+// locally at 5900 plus the device id.
+func (dev *Device) vncForward() forward {
+	return forward{Name: "vnc", Direction: "L", Bind: dev.getLoopbackAddr(), Port: dev.offset + 5900,
+		Host: "localhost", HostPort: dev.vncPort(), Protocol: "vnc"}
+}
+
+// heldVncForward returns the VNC forward held by one of the device's
+// connections, if there is one.
+func (dev *Device) heldVncForward() (forward, bool) {
+	for _, con := range dev.parent.sortedConnections() {
+		if con.dev != dev {
+			continue
+		}
+		for _, fwd := range con.forwards {
+			if fwd.Direction == "L" && fwd.Protocol == "vnc" {
+				return fwd, true
+			}
+		}
+	}
+	return forward{}, false
+}
+
+// vnc makes sure the device's VNC server is forwarded, and opens a viewer
+// on it. The forward is added to an open session if there is one, or else
+// to a background ssh -N connection that holds only it.
+func (dev *Device) vnc() error {
+	if !dev.vncEnabled() {
+		return fmt.Errorf("VNC is disabled for %s", dev.Serial)
+	}
+
+	fwd, held := dev.heldVncForward()
+	if !held {
+		var err error
+		if fwd, err = dev.forwardVnc(); err != nil {
+			return err
+		}
+	}
+
+	return openVncViewer(fwd.listenAddr())
+}
+
+// forwardVnc sets up the VNC forward, and returns it once it's listening.
+func (dev *Device) forwardVnc() (forward, error) {
+	if err := dev.tunnelSetup(); err != nil {
+		return forward{}, err
+	}
+	if config.UseLoopbackAddrs {
+		if err := enableLoopbackAddr(dev.getLoopbackAddr()); err != nil {
+			return forward{}, err
+		}
+	}
+
+	usable := checkPorts([]forward{dev.vncForward()})
+	if len(usable) == 0 {
+		return forward{}, errors.New("can't forward VNC")
+	}
+	fwd := usable[0]
+
+	if con, err := dev.parent.session(dev); err == nil {
+		if err = con.control("forward", fwd); err != nil {
+			return forward{}, err
+		}
+		con.forwards = append(con.forwards, fwd)
+		con.forwarded = true
+		fmt.Printf("forward: %s on connection %d\n", fwd, con.id)
+		return fwd, nil
+	}
+
+	args := strings.Fields(fmt.Sprintf("ssh -N %s %s -o BatchMode=yes -o ExitOnForwardFailure=yes -p %d %s %s@localhost",
+		dev.sshOptions(), dev.hostKeyOptions(), dev.port, fwd.arg(), dev.User))
+	if config.Verbose {
+		fmt.Println(strings.Join(args, " "))
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	if err := cmd.Start(); err != nil {
+		return forward{}, err
+	}
+
+	con := dev.parent.addConnection(&Connection{dev: dev, cmd: cmd, forwards: []forward{fwd}, forwardOnly: true})
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+		dev.parent.connectionFinish <- con
+	}()
+
+	deadline := time.Now().Add(vncForwardTimeout)
+	for {
+		if conn, err := net.DialTimeout("tcp", fwd.listenAddr(), time.Second); err == nil {
+			conn.Close()
+			break
+		}
+		select {
+		case <-exited:
+			return forward{}, fmt.Errorf("ssh for the VNC forward to %s exited", dev.Serial)
+		case <-time.After(200 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			con.close()
+			return forward{}, fmt.Errorf("VNC forward to %s didn't start listening", dev.Serial)
+		}
+	}
+
+	fmt.Printf("forward: %s on connection %d\n", fwd, con.id)
+	return fwd, nil
+}
+
+// openVncViewer starts the configured VncViewer on addr, with $host and
+// $port replaced, or else opens a vnc:// URL with the platform's handler.
+func openVncViewer(addr string) error {
+	host, port, _ := net.SplitHostPort(addr)
+	url := "vnc://" + addr
+
+	var args []string
+	if config.VncViewer != "" {
+		for _, arg := range strings.Fields(config.VncViewer) {
+			arg = strings.ReplaceAll(arg, "$host", host)
+			arg = strings.ReplaceAll(arg, "$port", port)
+			args = append(args, arg)
+		}
+	} else if runtime.GOOS == "windows" {
+		args = []string{"rundll32", "url.dll,FileProtocolHandler", url}
+	} else if runtime.GOOS == "darwin" {
+		args = []string{"open", url}
+	} else {
+		args = []string{"xdg-open", url}
+	}
+
+	fmt.Printf("vnc: opening %s\n", url)
+	if config.Verbose {
+		fmt.Println(strings.Join(args, " "))
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("can't start VNC viewer: %w", err)
+	}
+	go cmd.Wait()
+	return nil
+}
@@ -1,3 +1,394 @@
-// Stub for localhost web interface code.
+// Localhost web interface code: an html dashboard and a JSON API.
 
 package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The web server only ever runs on the loopback interface. Handlers never
+// touch the DeviceSet directly, instead they queue closures that the main
+// loop runs synchronously, the same as command-line input.
+type webServer struct {
+	dset  *DeviceSet
+	addr  string
+	calls chan func()
+}
+
+var web *webServer
+
+// Device and connection state, copied out of the DeviceSet by the main loop
+// so that rendering doesn't race with state changes.
+type deviceStatus struct {
+	Serial      string             `json:"serial"`
+	ID          int                `json:"id"`
+	User        string             `json:"user"`
+	Port        int                `json:"port"`
+	Location    string             `json:"allocation"`
+	Comment     string             `json:"notes"`
+	Tags        []string           `json:"tags,omitempty"`
+	Tunnel      string             `json:"tunnel"`
+	Mounted     bool               `json:"mounted"`
+	Online      string             `json:"online,omitempty"`
+	LastSeen    *time.Time         `json:"last_seen,omitempty"`
+	Connections []connectionStatus `json:"connections"`
+}
+
+type connectionStatus struct {
+	ID         int       `json:"id"`
+	Serial     string    `json:"serial"`
+	Kind       string    `json:"kind"`
+	Forwarded  bool      `json:"forwarded"`
+	Forwards   []forward `json:"forwards,omitempty"`
+	MountPoint string    `json:"mount_point,omitempty"`
+}
+
+type errorStatus struct {
+	Error string `json:"error"`
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>rdevcon</title>
+<meta http-equiv="refresh" content="5">
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { padding: 4px 10px; border-bottom: 1px solid #ccc; text-align: left; }
+form { display: inline; }
+</style>
+</head>
+<body>
+<h2>rdevcon devices</h2>
+{{if .Stale}}<p><b>{{.Stale}}</b></p>
+{{end}}<table>
+<tr><th>serial</th><th>id</th><th>allocation</th><th>notes</th><th>tunnel</th><th>status</th><th>connections</th><th>mount</th><th></th></tr>
+{{range .Devices}}<tr>
+<td>{{.Serial}}</td><td>{{.ID}}</td><td>{{.Location}}</td><td>{{.Comment}}</td>
+<td>{{.Tunnel}}</td><td>{{.Online}}</td><td>{{len .Connections}}</td><td>{{if .Mounted}}mounted{{end}}</td>
+<td>
+<form method="post" action="/action"><input type="hidden" name="serial" value="{{.Serial}}"><button name="action" value="connect">connect</button></form>
+<form method="post" action="/action"><input type="hidden" name="serial" value="{{.Serial}}"><button name="action" value="mount">mount</button></form>
+<form method="post" action="/action"><input type="hidden" name="serial" value="{{.Serial}}"><button name="action" value="vnc">vnc</button></form>
+</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// webStart starts the web server if a port is configured, and returns the
+// channel of calls for the main loop to run. A nil channel is returned if
+// the server isn't running, which never fires in a select.
+func webStart(dset *DeviceSet) chan func() {
+	if config.WebPort == 0 {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(config.WebPort)))
+	if err != nil {
+		fmt.Println("web:", err)
+		return nil
+	}
+
+	web = &webServer{dset: dset, addr: listener.Addr().String(), calls: make(chan func())}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", web.dashboard)
+	mux.HandleFunc("POST /action", web.action)
+	mux.HandleFunc("GET /devices", web.getDevices)
+	mux.HandleFunc("GET /devices/{serial}", web.getDevice)
+	mux.HandleFunc("POST /devices/{serial}/connect", web.postConnect)
+	mux.HandleFunc("POST /devices/{serial}/mount", web.postMount)
+	mux.HandleFunc("POST /devices/{serial}/vnc", web.postVnc)
+	mux.HandleFunc("GET /connections", web.getConnections)
+	mux.HandleFunc("DELETE /connections/{id}", web.deleteConnection)
+	mux.HandleFunc("GET /forwards", web.getForwards)
+
+	go http.Serve(listener, web.guard(mux))
+
+	webShow()
+
+	return web.calls
+}
+
+// webShow prints the dashboard address.
+func webShow() {
+	if web == nil {
+		fmt.Println("web dashboard not enabled, set WebPort in config.json")
+		return
+	}
+	fmt.Printf("Web dashboard and API at http://%s/\n", web.addr)
+}
+
+// call runs fn in the main loop and waits for it to complete.
+func (ws *webServer) call(fn func()) {
+	finished := make(chan bool, 1)
+	ws.calls <- func() {
+		fn()
+		finished <- true
+	}
+	<-finished
+}
+
+// guard rejects requests that weren't addressed to our own host:port, and
+// form posts from other origins, so that web pages loaded in a browser
+// can't drive connections.
+func (ws *webServer) guard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, port, _ := net.SplitHostPort(ws.addr)
+		if r.Host != ws.addr && r.Host != net.JoinHostPort("localhost", port) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" && origin != "http://"+r.Host {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// deviceCommand looks up a device by serial or id and runs a device method
+// on it in the main loop, echoing the equivalent prompt command and any
+// error to the console. Request data is never run as a prompt command.
+func (ws *webServer) deviceCommand(command string, serial string, fn func(*Device) error) (*Device, error) {
+	var dev *Device
+	var err error
+	ws.call(func() {
+		if dev = ws.dset.find(serial); dev == nil {
+			err = fmt.Errorf("%w: %s", errUnknownDevice, serial)
+			return
+		}
+		fmt.Printf("[web] %s %s\n", command, dev.Serial)
+		if err = fn(dev); err != nil {
+			fmt.Println(err)
+		}
+		fmt.Print("> ")
+	})
+	return dev, err
+}
+
+// Must be called from the main loop.
+func (dset *DeviceSet) status(dev *Device) deviceStatus {
+	status := deviceStatus{Serial: dev.Serial, ID: dev.offset, User: dev.User, Port: dev.port,
+		Location: dev.Location, Comment: dev.Comment, Tags: dev.Tags, Tunnel: tunnels.state(dev), Mounted: dev.mounted,
+		Connections: []connectionStatus{}}
+	if status.Tunnel == "" {
+		status.Tunnel = "down"
+	}
+	if !dev.probe.checked.IsZero() {
+		status.Online = "offline"
+		if dev.probe.online {
+			status.Online = "online"
+		}
+	}
+	if !dev.probe.lastSeen.IsZero() {
+		lastSeen := dev.probe.lastSeen
+		status.LastSeen = &lastSeen
+	}
+	for _, con := range dset.sortedConnections() {
+		if con.dev == dev {
+			status.Connections = append(status.Connections, con.status())
+		}
+	}
+	return status
+}
+
+func (con *Connection) status() connectionStatus {
+	return connectionStatus{ID: con.id, Serial: con.dev.Serial, Kind: con.kind(),
+		Forwarded: con.forwarded, Forwards: con.forwards, MountPoint: con.mountPoint}
+}
+
+// Must be called from the main loop.
+func (dset *DeviceSet) statusList() []deviceStatus {
+	devices := []deviceStatus{}
+	for _, dev := range dset.deviceList {
+		if dev.Hidden && !dset.unlockHidden {
+			continue
+		}
+		devices = append(devices, dset.status(dev))
+	}
+	return devices
+}
+
+func (ws *webServer) dashboard(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Devices []deviceStatus
+		Stale   string
+	}
+	ws.call(func() {
+		data.Devices = ws.dset.statusList()
+		data.Stale = ws.dset.staleNotice()
+	})
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, data); err != nil {
+		fmt.Println("web:", err)
+	}
+}
+
+// action handles the dashboard buttons by running the device method for
+// each.
+func (ws *webServer) action(w http.ResponseWriter, r *http.Request) {
+	serial := r.FormValue("serial")
+	if serial == "" {
+		http.Error(w, "missing serial", http.StatusBadRequest)
+		return
+	}
+
+	var fn func(*Device) error
+	switch r.FormValue("action") {
+	case "connect":
+		fn = (*Device).connect
+	case "mount":
+		fn = (*Device).mount
+	case "vnc":
+		fn = (*Device).vnc
+	default:
+		http.Error(w, "unknown action", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := ws.deviceCommand(r.FormValue("action"), serial, fn); errors.Is(err, errUnknownDevice) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func writeJSON(w http.ResponseWriter, code int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	if errors.Is(err, errUnknownDevice) || errors.Is(err, errUnknownConnection) {
+		code = http.StatusNotFound
+	}
+	writeJSON(w, code, errorStatus{err.Error()})
+}
+
+func (ws *webServer) getDevices(w http.ResponseWriter, r *http.Request) {
+	var devices []deviceStatus
+	var err error
+	ws.call(func() {
+		if r.URL.Query().Has("probe") {
+			err = ws.dset.probeStale()
+		}
+		devices = ws.dset.statusList()
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, devices)
+}
+
+func (ws *webServer) getDevice(w http.ResponseWriter, r *http.Request) {
+	serial := r.PathValue("serial")
+	var status *deviceStatus
+	ws.call(func() {
+		if dev := ws.dset.find(serial); dev != nil {
+			s := ws.dset.status(dev)
+			status = &s
+		}
+	})
+	if status == nil {
+		writeError(w, fmt.Errorf("%w: %s", errUnknownDevice, serial))
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (ws *webServer) postConnect(w http.ResponseWriter, r *http.Request) {
+	ws.startConnection(w, r.PathValue("serial"), "connect", (*Device).connect)
+}
+
+func (ws *webServer) postMount(w http.ResponseWriter, r *http.Request) {
+	ws.startConnection(w, r.PathValue("serial"), "mount", (*Device).mount)
+}
+
+func (ws *webServer) postVnc(w http.ResponseWriter, r *http.Request) {
+	ws.startConnection(w, r.PathValue("serial"), "vnc", (*Device).vnc)
+}
+
+// startConnection connects, mounts or opens VNC for a device, and responds
+// with the connections it created.
+func (ws *webServer) startConnection(w http.ResponseWriter, serial string, command string, fn func(*Device) error) {
+	var lastID int
+	ws.call(func() {
+		lastID = ws.dset.lastConnectionID
+	})
+
+	dev, err := ws.deviceCommand(command, serial, fn)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	created := []connectionStatus{}
+	ws.call(func() {
+		for _, con := range ws.dset.sortedConnections() {
+			if con.id > lastID && con.dev == dev {
+				created = append(created, con.status())
+			}
+		}
+	})
+	writeJSON(w, http.StatusCreated, created)
+}
+
+func (ws *webServer) getConnections(w http.ResponseWriter, r *http.Request) {
+	connections := []connectionStatus{}
+	ws.call(func() {
+		for _, con := range ws.dset.sortedConnections() {
+			connections = append(connections, con.status())
+		}
+	})
+	writeJSON(w, http.StatusOK, connections)
+}
+
+func (ws *webServer) getForwards(w http.ResponseWriter, r *http.Request) {
+	var forwards []forwardStatus
+	ws.call(func() {
+		forwards = ws.dset.forwardTable()
+	})
+	writeJSON(w, http.StatusOK, forwards)
+}
+
+func (ws *webServer) deleteConnection(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorStatus{"invalid connection id"})
+		return
+	}
+
+	ws.call(func() {
+		con := ws.dset.findConnection(id)
+		if con == nil {
+			err = fmt.Errorf("%w: %d", errUnknownConnection, id)
+			return
+		}
+		fmt.Printf("[web] close %d\n", id)
+		if err = con.close(); err != nil {
+			fmt.Println(err)
+		}
+		fmt.Print("> ")
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}